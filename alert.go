@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Alert states.
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Settings of sending webhooks.
+const (
+	webhookTimeout   = 10 * time.Second
+	webhookQueueSize = 100
+)
+
+// alertOps maps comparison operators of rules to functions.
+var alertOps = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+}
+
+// Alert is the state of a rule for a device.
+type Alert struct {
+	Rule   string    `json:"rule"`
+	MAC    string    `json:"mac"`
+	Device Device    `json:"device"`
+	State  string    `json:"state"`
+	Value  float64   `json:"value"` // last sensor value, or seconds since the last message for offline rules
+	Since  time.Time `json:"since"` // time of the last state change
+}
+
+type alertKey struct {
+	rule string
+	mac  string
+}
+
+// Alerter evaluates alert rules against incoming readings and liveness
+// of devices, and sends notifications to webhooks when alerts fire
+// or resolve.
+//
+// Value rules use device timestamps of readings, so history batches are
+// evaluated as if they came in real time. Offline rules are checked
+// periodically against server time.
+type Alerter struct {
+	conf     AlertsConfig
+	devices  Devices
+	webhooks []*webhook
+	alerts   map[alertKey]*Alert
+	checked  map[alertKey]time.Time // time of the last evaluated reading
+	lastSeen func() map[string]time.Time
+	notify   chan Alert
+	reset    chan time.Duration
+	done     chan struct{}
+	once     sync.Once
+	mx       sync.Mutex
+	wg       sync.WaitGroup
+	metrics  *Metrics
+	log      *logrus.Logger
+}
+
+// webhook sends alerts as HTTP requests.
+type webhook struct {
+	url     string
+	tmpl    *template.Template // nil to send alert as JSON
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewAlerter creates a new alerter. The lastSeen function returns time
+// of the last message of every known device.
+func NewAlerter(
+	conf Config,
+	lastSeen func() map[string]time.Time,
+	metrics *Metrics,
+	log *logrus.Logger,
+) (*Alerter, error) {
+	a := &Alerter{
+		alerts:   make(map[alertKey]*Alert),
+		checked:  make(map[alertKey]time.Time),
+		lastSeen: lastSeen,
+		notify:   make(chan Alert, webhookQueueSize),
+		reset:    make(chan time.Duration, 1),
+		done:     make(chan struct{}),
+		metrics:  metrics,
+		log:      log,
+	}
+	if err := a.SetConfig(conf); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetConfig replaces rules, webhooks and the device registry. State of
+// alerts is kept for rules that still exist.
+func (a *Alerter) SetConfig(conf Config) error {
+	webhooks := make([]*webhook, 0, len(conf.Alerts.Webhooks))
+	for i, w := range conf.Alerts.Webhooks {
+		hook := &webhook{
+			url:     w.URL,
+			headers: w.Headers,
+			client:  &http.Client{Timeout: webhookTimeout},
+		}
+		if w.Template != "" {
+			tmpl, err := parseWebhookTemplate(w.URL, w.Template)
+			if err != nil {
+				return fmt.Errorf("parse template of webhook %d: %w", i, err)
+			}
+			hook.tmpl = tmpl
+		}
+		webhooks = append(webhooks, hook)
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.conf = conf.Alerts
+	a.devices = conf.Devices
+	a.webhooks = webhooks
+	for key := range a.alerts {
+		if !slices.ContainsFunc(a.conf.Rules, func(r AlertRule) bool { return r.Name == key.rule }) {
+			a.metrics.AlertFiringGauge.DeleteLabelValues(key.rule, key.mac)
+			delete(a.alerts, key)
+			delete(a.checked, key)
+		}
+	}
+
+	// Let the loop pick up the new interval
+	select {
+	case a.reset <- a.conf.CheckInterval:
+	default:
+	}
+	return nil
+}
+
+// Start starts background loops that check offline devices and send
+// notifications until the context is canceled or Stop is called.
+func (a *Alerter) Start(ctx context.Context) {
+	a.mx.Lock()
+	interval := a.conf.CheckInterval
+	a.mx.Unlock()
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.done:
+				return
+			case d := <-a.reset:
+				ticker.Reset(d)
+			case <-ticker.C:
+				a.CheckOffline(time.Now())
+			}
+		}
+	}()
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case alert := <-a.notify:
+				a.send(alert)
+			case <-a.done:
+				// Send the rest of notifications
+				for {
+					select {
+					case alert := <-a.notify:
+						a.send(alert)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops background loops and waits for queued notifications
+// to be sent.
+func (a *Alerter) Stop() {
+	a.once.Do(func() { close(a.done) })
+	a.wg.Wait()
+}
+
+// Evaluate checks value rules against the readings.
+func (a *Alerter) Evaluate(readings []Reading) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for _, r := range readings {
+		dev := a.devices.Get(r.MAC)
+		for _, rule := range a.conf.Rules {
+			value, ok := r.Fields[rule.Field]
+			if rule.Offline > 0 || !ok || !rule.Match.Matches(r.MAC, dev) {
+				continue
+			}
+			key := alertKey{rule: rule.Name, mac: r.MAC}
+			if r.Time.Before(a.checked[key]) {
+				continue
+			}
+			a.checked[key] = r.Time
+
+			op := alertOps[rule.Op]
+			threshold := rule.Threshold
+			if strings.HasPrefix(rule.Op, ">") {
+				threshold -= rule.Hysteresis
+			} else {
+				threshold += rule.Hysteresis
+			}
+			active := op(value, rule.Threshold)
+			cleared := !op(value, threshold)
+			a.update(rule, r.MAC, dev, value, active, cleared, r.Time)
+		}
+	}
+}
+
+// CheckOffline evaluates offline rules.
+func (a *Alerter) CheckOffline(now time.Time) {
+	seen := a.lastSeen()
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for mac, t := range seen {
+		dev := a.devices.Get(mac)
+		for _, rule := range a.conf.Rules {
+			if rule.Offline == 0 || !rule.Match.Matches(mac, dev) {
+				continue
+			}
+			silent := now.Sub(t)
+			active := silent > rule.Offline
+			a.update(rule, mac, dev, silent.Seconds(), active, !active, now)
+		}
+	}
+}
+
+// update moves the alert to the next state. Active means the condition
+// of the rule is true, cleared means the firing alert can be resolved.
+func (a *Alerter) update(rule AlertRule, mac string, dev Device, value float64, active, cleared bool, t time.Time) {
+	key := alertKey{rule: rule.Name, mac: mac}
+	alert, ok := a.alerts[key]
+	if !ok {
+		if !active {
+			return
+		}
+		alert = &Alert{Rule: rule.Name, MAC: mac, State: AlertPending, Since: t}
+		a.alerts[key] = alert
+	}
+	alert.Device = dev
+	alert.Value = value
+
+	switch alert.State {
+	case AlertPending:
+		if !active {
+			delete(a.alerts, key)
+			return
+		}
+		if t.Sub(alert.Since) >= rule.For {
+			alert.State = AlertFiring
+			alert.Since = t
+			a.metrics.AlertFiringGauge.WithLabelValues(rule.Name, mac).Set(1)
+			a.log.WithFields(logrus.Fields{"rule": rule.Name, "mac": mac}).Info("Alert is firing")
+			a.enqueue(*alert)
+		}
+	case AlertFiring:
+		if cleared {
+			alert.State = AlertResolved
+			alert.Since = t
+			a.metrics.AlertFiringGauge.WithLabelValues(rule.Name, mac).Set(0)
+			a.log.WithFields(logrus.Fields{"rule": rule.Name, "mac": mac}).Info("Alert is resolved")
+			a.enqueue(*alert)
+			delete(a.alerts, key)
+		}
+	}
+}
+
+// enqueue puts the alert to the notification queue. Notifications are
+// dropped if the queue is full.
+func (a *Alerter) enqueue(alert Alert) {
+	if len(a.webhooks) == 0 {
+		return
+	}
+	select {
+	case a.notify <- alert:
+	default:
+		a.metrics.AlertNotificationErrorsCounter.Inc()
+		a.log.WithField("rule", alert.Rule).Warn("Dropped alert notification: queue is full")
+	}
+}
+
+// Alerts returns pending and firing alerts sorted by rule and MAC.
+func (a *Alerter) Alerts() []Alert {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	alerts := make([]Alert, 0, len(a.alerts))
+	for _, alert := range a.alerts {
+		alerts = append(alerts, *alert)
+	}
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		return strings.Compare(a.Rule+"/"+a.MAC, b.Rule+"/"+b.MAC)
+	})
+	return alerts
+}
+
+// send sends the notification to all webhooks with retries.
+func (a *Alerter) send(alert Alert) {
+	a.mx.Lock()
+	webhooks := a.webhooks
+	a.mx.Unlock()
+
+	for _, w := range webhooks {
+		var err error
+		backoff := SinkBackoff
+		for attempt := range sinkRetries {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			err = w.send(alert)
+			if !errors.Is(err, errRetryable) {
+				break
+			}
+		}
+		if err != nil {
+			a.metrics.AlertNotificationErrorsCounter.Inc()
+			a.log.WithError(err).WithField("rule", alert.Rule).Error("Failed to send alert notification")
+			continue
+		}
+		a.metrics.AlertNotificationsSentCounter.Inc()
+	}
+}
+
+// parseWebhookTemplate parses the template of webhook body. The json
+// function encodes a value as JSON, so values are escaped in the body,
+// e.g. {"text": {{json .Device.Name}}}.
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	funcs := template.FuncMap{"json": templateJSON}
+	return template.New(name).Funcs(funcs).Parse(text) //nolint:wrapcheck
+}
+
+// templateJSON encodes the value as JSON.
+func templateJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("encode json: %w", err)
+	}
+	return string(data), nil
+}
+
+// send posts the alert to the webhook.
+func (w *webhook) send(alert Alert) error {
+	var body bytes.Buffer
+	if w.tmpl != nil {
+		if err := w.tmpl.Execute(&body, alert); err != nil {
+			return fmt.Errorf("execute template: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(alert); err != nil {
+		return fmt.Errorf("encode alert: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: send request: %w", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status %d: %s", errRetryable, resp.StatusCode, msg)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// Matches reports whether the device is selected.
+func (m DeviceMatch) Matches(mac string, dev Device) bool {
+	return (m.MAC == "" || m.MAC == mac) &&
+		(m.Name == "" || m.Name == dev.Name) &&
+		(m.Model == "" || m.Model == dev.Model)
+}
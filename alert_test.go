@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAlerter(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+
+	var (
+		bodies []string
+		mx     sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mx.Lock()
+		bodies = append(bodies, r.Header.Get("X-Token")+" "+string(body))
+		mx.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf := DefaultConfig()
+	conf.Devices = Devices{"MAC1": {Name: "office"}}
+	conf.Alerts.Rules = []AlertRule{
+		{
+			Name:       "high_co2",
+			Match:      DeviceMatch{Name: "office"},
+			Field:      "co2",
+			Op:         ">",
+			Threshold:  1200,
+			Hysteresis: 100,
+			For:        10 * time.Minute,
+		},
+		{Name: "offline", Offline: 15 * time.Minute},
+	}
+	conf.Alerts.Webhooks = []WebhookConfig{{
+		URL:      srv.URL,
+		Template: `{{.Rule}} {{.State}} {{.Device.Name}} {{.Value}}`,
+		Headers:  map[string]string{"X-Token": "secret"},
+	}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	seen := map[string]time.Time{"MAC1": start, "MAC2": start}
+	a, err := NewAlerter(conf, func() map[string]time.Time { return seen }, NewMetrics(MetricsConfig{}), log)
+	if err != nil {
+		t.Fatalf("Failed to create alerter: %v", err)
+	}
+	a.Start(context.Background())
+
+	co2 := func(mac string, minutes int, value float64) Reading {
+		return Reading{
+			MAC:    mac,
+			Time:   start.Add(time.Duration(minutes) * time.Minute),
+			Fields: map[string]float64{"co2": value},
+		}
+	}
+	states := func() []string {
+		var list []string
+		for _, alert := range a.Alerts() {
+			list = append(list, alert.Rule+"/"+alert.MAC+"/"+alert.State)
+		}
+		return list
+	}
+
+	// Pending until the condition holds for 10 minutes
+	a.Evaluate([]Reading{co2("MAC1", 0, 1300), co2("MAC2", 0, 2000)})
+	assertStrings(t, states(), []string{"high_co2/MAC1/pending"})
+	a.Evaluate([]Reading{co2("MAC1", 5, 1250)})
+	assertStrings(t, states(), []string{"high_co2/MAC1/pending"})
+	a.Evaluate([]Reading{co2("MAC1", 10, 1250)})
+	assertStrings(t, states(), []string{"high_co2/MAC1/firing"})
+
+	// Stays firing within hysteresis, out of order samples are ignored
+	a.Evaluate([]Reading{co2("MAC1", 11, 1150), co2("MAC1", 1, 500)})
+	assertStrings(t, states(), []string{"high_co2/MAC1/firing"})
+	a.Evaluate([]Reading{co2("MAC1", 12, 1000)})
+	assertStrings(t, states(), nil)
+
+	// Offline
+	seen["MAC1"] = start.Add(20 * time.Minute)
+	a.CheckOffline(start.Add(30 * time.Minute))
+	assertStrings(t, states(), []string{"offline/MAC2/firing"})
+	seen["MAC2"] = start.Add(31 * time.Minute)
+	a.CheckOffline(start.Add(31 * time.Minute))
+	assertStrings(t, states(), nil)
+
+	a.Stop()
+
+	expected := []string{
+		"secret high_co2 firing office 1250",
+		"secret high_co2 resolved office 1000",
+		"secret offline firing  1800",
+		"secret offline resolved  0",
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	assertStrings(t, bodies, expected)
+}
+
+func assertStrings(t *testing.T, got, expected []string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	tmpl, err := parseWebhookTemplate("test",
+		`{"text": {{json (printf "%s is %s for %s (%s): %v" .Rule .State .Device.Name .MAC .Value)}}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	alert := Alert{
+		Rule:   "high_co2",
+		MAC:    "MAC1",
+		Device: Device{Name: `"office" \ 1`},
+		State:  AlertFiring,
+		Value:  1300,
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, alert); err != nil {
+		t.Fatalf("Failed to execute template: %v", err)
+	}
+	var msg struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(body.Bytes(), &msg); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", body.String(), err)
+	}
+	if msg.Text != `high_co2 is firing for "office" \ 1 (MAC1): 1300` {
+		t.Fatalf("Unexpected text: %s", msg.Text)
+	}
+}
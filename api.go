@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadingsResponse is the response of the device readings endpoint.
+type ReadingsResponse struct {
+	MAC    string  `json:"mac"`
+	Field  string  `json:"field"`
+	Step   string  `json:"step,omitempty"`
+	Agg    string  `json:"agg,omitempty"`
+	Points []Point `json:"points"`
+}
+
+// ReadingsHandler returns handler for historical readings of a device.
+//
+// Query parameters:
+//   - field: name of a field of readings (required), e.g. co2,
+//     temperature_fahrenheit or co2_raw, see ValidField
+//   - from, to: time range in RFC3339 or unix seconds
+//   - step: downsampling step, e.g. 5m
+//   - agg: aggregation function for downsampling: avg (default), min, max
+//   - format: json (default) or csv
+func ReadingsHandler(history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		mac := r.PathValue("mac")
+
+		field := q.Get("field")
+		if !ValidField(field) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid field '%s'", field))
+			return
+		}
+		from, err := parseTime(q.Get("from"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+			return
+		}
+		to, err := parseTime(q.Get("to"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+			return
+		}
+		var step time.Duration
+		if s := q.Get("step"); s != "" {
+			step, err = time.ParseDuration(s)
+			if err != nil || step <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid step '%s'", s))
+				return
+			}
+		}
+		agg := q.Get("agg")
+		if agg == "" {
+			agg = AggAvg
+		}
+		if !slices.Contains([]string{AggAvg, AggMin, AggMax}, agg) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid agg '%s'", agg))
+			return
+		}
+
+		points, ok := history.Query(mac, field, from, to)
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("device not found"))
+			return
+		}
+		resp := ReadingsResponse{
+			MAC:    mac,
+			Field:  field,
+			Points: points,
+		}
+		if step > 0 {
+			resp.Step = step.String()
+			resp.Agg = agg
+			resp.Points = Downsample(points, step, agg)
+		}
+
+		if q.Get("format") == "csv" || r.Header.Get("Accept") == "text/csv" {
+			writeReadingsCSV(w, resp)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// DevicesResponse is the response of the devices endpoint.
+type DevicesResponse struct {
+	Devices []DeviceState `json:"devices"`
+}
+
+// DevicesHandler returns handler for current states of all devices.
+func DevicesHandler(states *DeviceStates) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, DevicesResponse{Devices: states.List()})
+	}
+}
+
+// DeviceHandler returns handler for current state of a single device.
+func DeviceHandler(states *DeviceStates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, ok := states.Get(r.PathValue("mac"))
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("device not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+// eventsKeepAlive is the interval of comments sent to idle event streams
+// to keep connections open through proxies.
+const eventsKeepAlive = 15 * time.Second
+
+// EventsHandler returns handler for the stream of device events
+// in Server-Sent Events format.
+//
+// Query parameters:
+//   - mac: MAC addresses of devices, comma separated or repeated
+//   - type: event types, comma separated or repeated, see EventTypes
+func EventsHandler(events *Events) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := EventFilter{
+			MACs:  splitQuery(q["mac"]),
+			Types: splitQuery(q["type"]),
+		}
+		for _, typ := range filter.Types {
+			if !slices.Contains(EventTypes, typ) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid type '%s'", typ))
+				return
+			}
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		ch, unsubscribe := events.Subscribe(filter)
+		defer unsubscribe()
+
+		ticker := time.NewTicker(eventsKeepAlive)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			case e := <-ch:
+				err = writeEvent(w, e)
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes the event in Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err //nolint:wrapcheck
+}
+
+// splitQuery splits comma separated values of a query parameter.
+func splitQuery(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for s := range strings.SplitSeq(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// HealthHandler returns handler for health checks. It responds with
+// 503 status when the check fails.
+func HealthHandler(check func() HealthResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		resp := check()
+		status := http.StatusOK
+		if resp.Status != HealthOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, resp)
+	}
+}
+
+// ClientsResponse is the response of the clients endpoint.
+type ClientsResponse struct {
+	Clients []ClientInfo `json:"clients"`
+}
+
+// ClientsHandler returns handler for sessions of MQTT clients.
+func ClientsHandler(broker *MQTTBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, ClientsResponse{Clients: broker.Clients()})
+	}
+}
+
+// KickClientHandler returns handler that disconnects an MQTT client.
+func KickClientHandler(broker *MQTTBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := broker.Kick(r.PathValue("id"))
+		if errors.Is(err, ErrClientNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AlertsResponse is the response of the alerts endpoint.
+type AlertsResponse struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+// AlertsHandler returns handler for pending and firing alerts.
+func AlertsHandler(alerter *Alerter) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, AlertsResponse{Alerts: alerter.Alerts()})
+	}
+}
+
+// ReloadResponse is the response of the config reload endpoint.
+type ReloadResponse struct {
+	Changes []string `json:"changes"`
+}
+
+// ReloadHandler returns handler that reloads the configuration. Invalid
+// configuration is a client error, failures to read it or to apply it
+// are server errors.
+func ReloadHandler(reload func() ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		changes, err := reload()
+		if errors.Is(err, ErrInvalidConfig) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if changes == nil {
+			changes = []string{}
+		}
+		writeJSON(w, http.StatusOK, ReloadResponse{Changes: changes})
+	}
+}
+
+// parseTime parses time in RFC3339 format or as unix seconds.
+// Empty string gives zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse time '%s'", s)
+	}
+	return t, nil
+}
+
+func writeReadingsCSV(w http.ResponseWriter, resp ReadingsResponse) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", resp.Field}) //nolint:errcheck,gosec
+	for _, p := range resp.Points {
+		cw.Write([]string{ //nolint:errcheck,gosec
+			p.Time.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(p.Value, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck,gosec
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -4,44 +4,115 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
 // App represents the application with all its components.
 type App struct {
-	http *http.Server
-	mqtt *MQTTBroker
+	http    *http.Server
+	auth    *HTTPAuth
+	mqtt    *MQTTBroker
+	calib   *Calibrator
+	states  *DeviceStates
+	events  *Events
+	sinks   *Sinks
+	alert   *Alerter
+	metrics *Metrics
+	env     SinkEnv
+	conf    Config
+	load    LoadFunc
+	log     *logrus.Logger
+	mx      sync.RWMutex
+
+	// Sinks replaced on reload, they write the rest of queued readings
+	// in background
+	stopping sync.WaitGroup
 }
 
+// LoadFunc loads the configuration for reload.
+type LoadFunc func() (Config, error)
+
 // NewApp creates and initializes a new application instance.
-func NewApp(httpAddr, mqttAddr string, log *logrus.Logger) (*App, error) {
-	var app App
+// The load function is used to get the new configuration on reload.
+func NewApp(conf Config, load LoadFunc, log *logrus.Logger) (*App, error) {
+	metrics := NewMetrics(conf.Metrics)
+	app := App{
+		auth:    NewHTTPAuth(conf.HTTP.Auth),
+		calib:   NewCalibrator(conf),
+		states:  NewDeviceStates(conf.Devices),
+		events:  NewEvents(metrics),
+		metrics: metrics,
+		conf:    conf,
+		load:    load,
+		log:     log,
+	}
 
 	// Create HTTP server
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "ok"}`)) //nolint:errcheck,gosec
-	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/health", HealthHandler(func() HealthResponse { return app.Health(false) }))
+	mux.HandleFunc("/ready", HealthHandler(func() HealthResponse { return app.Health(true) }))
+	history := NewHistory(HistorySize)
+	mux.HandleFunc("GET /api/devices", DevicesHandler(app.states))
+	mux.HandleFunc("GET /api/devices/{mac}", DeviceHandler(app.states))
+	mux.HandleFunc("GET /api/devices/{mac}/readings", ReadingsHandler(history))
+	mux.HandleFunc("GET /api/events", EventsHandler(app.events))
+	mux.HandleFunc("POST /api/admin/reload", ReloadHandler(app.Reload))
+	mux.Handle("/", WebHandler())
 	//nolint:gosec
 	app.http = &http.Server{
-		Addr:    httpAddr,
-		Handler: mux,
+		Addr:    conf.Listeners.HTTP,
+		Handler: app.auth.Middleware(mux),
 	}
+	// Cancel contexts of long-lived requests, such as event streams,
+	// on shutdown, otherwise it waits for them until timeout
+	baseCtx, cancel := context.WithCancel(context.Background())
+	app.http.BaseContext = func(net.Listener) context.Context { return baseCtx }
+	app.http.RegisterOnShutdown(cancel)
 
 	// Create MQTT broker
-	broker, err := NewMQTTBroker(mqttAddr, log)
+	store := func(readings ...Reading) {
+		app.mx.RLock()
+		defer app.mx.RUnlock()
+		app.calib.Apply(readings)
+		app.states.Update(readings)
+		app.sinks.Write(readings...)
+		app.alert.Evaluate(readings)
+	}
+	broker, err := NewMQTTBroker(conf, app.states, app.events, metrics, store, log)
 	if err != nil {
 		return nil, fmt.Errorf("create MQTT broker: %w", err)
 	}
 	app.mqtt = broker
+	mux.HandleFunc("GET /api/clients", ClientsHandler(broker))
+	mux.HandleFunc("DELETE /api/clients/{id}", KickClientHandler(broker))
+
+	// Create alerting
+	app.alert, err = NewAlerter(conf, app.states.LastSeen, metrics, log)
+	if err != nil {
+		return nil, fmt.Errorf("create alerter: %w", err)
+	}
+	mux.HandleFunc("GET /api/alerts", AlertsHandler(app.alert))
+
+	// Create sinks
+	app.env = SinkEnv{
+		History: history,
+		Publish: broker.Publish,
+		Metrics: metrics,
+		Log:     log,
+	}
+	app.sinks, err = NewSinks(conf, app.env)
+	if err != nil {
+		return nil, fmt.Errorf("create sinks: %w", err)
+	}
+	metrics.SetUnits(conf.Outputs.Units["prometheus"])
 
 	return &app, nil
 }
@@ -50,6 +121,16 @@ func NewApp(httpAddr, mqttAddr string, log *logrus.Logger) (*App, error) {
 func (a *App) Start(ctx context.Context) error {
 	var g errgroup.Group
 
+	// Start sinks, they are stopped by Stop after the rest of received
+	// messages is processed
+	a.mx.RLock()
+	a.sinks.Start()
+	tls := a.conf.HTTP.TLS
+	a.mx.RUnlock()
+
+	// Start alerting
+	a.alert.Start(ctx)
+
 	// Start MQTT broker
 	g.Go(func() error {
 		err := a.mqtt.Start(ctx)
@@ -61,7 +142,12 @@ func (a *App) Start(ctx context.Context) error {
 
 	// Start HTTP server
 	g.Go(func() error {
-		err := a.http.ListenAndServe()
+		var err error
+		if tls.Enabled() {
+			err = a.http.ListenAndServeTLS(tls.CertFile, tls.KeyFile)
+		} else {
+			err = a.http.ListenAndServe()
+		}
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("HTTP server error: %w", err)
 		}
@@ -80,6 +166,18 @@ func (a *App) Stop() error {
 		errs = append(errs, fmt.Errorf("MQTT broker shutdown error: %w", err))
 	}
 
+	// Write the rest of queued readings
+	a.mx.RLock()
+	sinks := a.sinks
+	a.mx.RUnlock()
+	if err := sinks.Stop(); err != nil {
+		errs = append(errs, fmt.Errorf("sinks shutdown error: %w", err))
+	}
+	a.stopping.Wait()
+
+	// Send the rest of alert notifications
+	a.alert.Stop()
+
 	// Shutdown HTTP server
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -89,3 +187,119 @@ func (a *App) Stop() error {
 
 	return errors.Join(errs...)
 }
+
+// Health checks components of the application. Readiness takes into
+// account all checks, liveness only critical ones.
+func (a *App) Health(ready bool) HealthResponse {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return CheckHealth(a.mqtt.Status(), a.sinks.Status(), a.conf.Health, ready, time.Now())
+}
+
+// Reload loads the configuration and applies changes that don't require
+// restart: device registry, calibration, MQTT and HTTP auth, alert rules,
+// health checks, log level and outputs. Invalid configuration is rejected, and
+// the current one is kept. Returns the list of changes.
+func (a *App) Reload() ([]string, error) {
+	conf, err := a.load()
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	old := a.conf
+	changes := old.Diff(conf)
+	if len(changes) == 0 {
+		a.log.Info("Config reloaded, no changes")
+		return changes, nil
+	}
+
+	// Steps that can fail go first, outputs are replaced only when
+	// everything else succeeds
+	var sinks *Sinks
+	if !reflect.DeepEqual(old.Outputs, conf.Outputs) {
+		sinks, err = NewSinks(conf, a.env)
+		if err != nil {
+			return nil, fmt.Errorf("create sinks: %w", err)
+		}
+	}
+	if !reflect.DeepEqual(old.Alerts, conf.Alerts) || !reflect.DeepEqual(old.Devices, conf.Devices) {
+		if err := a.alert.SetConfig(conf); err != nil {
+			if sinks != nil {
+				sinks.Stop() //nolint:errcheck,gosec
+			}
+			return nil, fmt.Errorf("%w: set alerts: %w", ErrInvalidConfig, err)
+		}
+	}
+	if sinks != nil {
+		sinks.Start()
+		prev := a.sinks
+		a.sinks = sinks
+		a.metrics.SetUnits(conf.Outputs.Units["prometheus"])
+		a.stopping.Add(1)
+		go func() {
+			defer a.stopping.Done()
+			if err := prev.Stop(); err != nil {
+				a.log.Errorf("Failed to stop old sinks: %v", err)
+			}
+		}()
+	}
+	if !reflect.DeepEqual(old.Devices, conf.Devices) {
+		a.sinks.SetDevices(conf.Devices)
+		a.states.SetDevices(conf.Devices)
+	}
+	if !reflect.DeepEqual(old.Calibration, conf.Calibration) || !reflect.DeepEqual(old.Devices, conf.Devices) {
+		a.calib.SetConfig(conf)
+	}
+	if !reflect.DeepEqual(old.Auth, conf.Auth) {
+		a.mqtt.SetAuth(conf.Auth)
+	}
+	if !reflect.DeepEqual(old.HTTP.Auth, conf.HTTP.Auth) {
+		a.auth.Set(conf.HTTP.Auth)
+	}
+	if old.Logging != conf.Logging {
+		setLogging(a.log, conf.Logging)
+	}
+
+	// Keep settings that can't be changed without restart
+	restart := []struct {
+		section string
+		changed bool
+	}{
+		{"listeners", old.Listeners != conf.Listeners},
+		{"http.tls", old.HTTP.TLS != conf.HTTP.TLS},
+		{"pipeline", old.Pipeline != conf.Pipeline},
+		{"clock", old.Clock != conf.Clock},
+		{"liveness", old.Liveness != conf.Liveness},
+		{"metrics", old.Metrics != conf.Metrics},
+	}
+	conf.Listeners, conf.HTTP.TLS, conf.Pipeline, conf.Clock, conf.Liveness, conf.Metrics =
+		old.Listeners, old.HTTP.TLS, old.Pipeline, old.Clock, old.Liveness, old.Metrics
+	a.conf = conf
+
+	for _, change := range changes {
+		a.log.WithField("change", change).Info("Config changed")
+	}
+	for _, r := range restart {
+		if r.changed {
+			a.log.Warnf("Changes in '%s' section require restart", r.section)
+		}
+	}
+	return changes, nil
+}
+
+// setLogging applies logging configuration. The level must be valid.
+func setLogging(log *logrus.Logger, conf LoggingConfig) {
+	level, _ := logrus.ParseLevel(conf.Level)
+	log.SetLevel(level)
+	if conf.Format == "json" {
+		log.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+}
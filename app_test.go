@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -13,37 +18,31 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// historyMessage is a history data message of device 112233445566
+// that requires acknowledgment.
+const historyMessage = `{
+	"type": "17",
+	"id": 12345,
+	"need_ack": 1,
+	"mac": "112233445566",
+	"timestamp": 1594815555,
+	"sensorData": [{
+		"timestamp": {"value": 1592192453},
+		"temperature": {"value": 23.5},
+		"humidity": {"value": 45.2},
+		"co2": {"value": 850},
+		"pm25": {"value": 12.3},
+		"pm10": {"value": 15.8},
+		"battery": {"value": 85}
+	}]
+}`
+
+// Every scenario starts its own application, so they don't depend
+// on each other.
 func TestApp(t *testing.T) {
-	ctx := context.Background()
-	log := logrus.New()
-	log.Out = io.Discard
-
-	httpAddr := "127.0.0.1:18080"
-	mqttAddr := "127.0.0.1:11883"
-
-	// Set a short interval for testing
-	HeartbeatInterval = 50 * time.Millisecond
-
-	app, err := NewApp(httpAddr, mqttAddr, log)
-	if err != nil {
-		t.Fatalf("Failed to create app: %v", err)
-	}
-
-	go func() {
-		if err := app.Start(ctx); err != nil {
-			t.Errorf("Failed to start app: %v", err)
-		}
-	}()
-	defer func() {
-		if err := app.Stop(); err != nil {
-			t.Errorf("Failed to stop app: %v", err)
-		}
-	}()
-
-	// Wait for services to start
-	time.Sleep(10 * time.Millisecond)
-
 	t.Run("health endpoint", func(t *testing.T) {
+		httpAddr, _ := startApp(t, testConfig(t), nil)
+
 		resp, err := http.Get(fmt.Sprintf("http://%s/health", httpAddr))
 		if err != nil {
 			t.Fatalf("Failed to call health endpoint: %v", err)
@@ -55,7 +54,30 @@ func TestApp(t *testing.T) {
 		}
 	})
 
+	t.Run("readiness endpoint", func(t *testing.T) {
+		httpAddr, _ := startApp(t, testConfig(t), nil)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/ready", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to call readiness endpoint: %v", err)
+		}
+		var resp HealthResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		names := make([]string, 0, len(resp.Checks))
+		for _, c := range resp.Checks {
+			names = append(names, c.Name)
+		}
+		expected := []string{"mqtt", "sink:prometheus", "sink:history"}
+		if resp.Status != HealthOK || !slices.Equal(names, expected) {
+			t.Fatalf("Unexpected readiness: %s", body)
+		}
+	})
+
 	t.Run("metrics endpoint", func(t *testing.T) {
+		httpAddr, _ := startApp(t, testConfig(t), nil)
+
 		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
 		if err != nil {
 			t.Fatalf("Failed to call metrics endpoint: %v", err)
@@ -65,9 +87,132 @@ func TestApp(t *testing.T) {
 		if resp.StatusCode != http.StatusOK {
 			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
 		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read body: %v", err)
+		}
+		if !strings.Contains(string(body), "go_goroutines ") {
+			t.Fatal("Expected runtime metrics")
+		}
+	})
+
+	t.Run("web dashboard", func(t *testing.T) {
+		httpAddr, _ := startApp(t, testConfig(t), nil)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read dashboard: %v", err)
+		}
+		if !strings.Contains(body, "<title>Qingping</title>") {
+			t.Fatalf("Unexpected dashboard: %s", body)
+		}
 	})
 
 	t.Run("send mqtt message and verify metrics", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage)
+		if err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/metrics", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read metrics: %v", err)
+		}
+
+		expected := []string{
+			`qingping_mqtt_messages_received_total{mac="112233445566",topic="qingping/test-device/up",type="17"} 1`,
+			`qingping_temperature_celsius{mac="112233445566"} 23.5`,
+			`qingping_humidity_percent{mac="112233445566"} 45.2`,
+			`qingping_co2_ppm{mac="112233445566"} 850`,
+			// Broker metrics
+			`qingping_broker_packets_total{direction="received",type="publish"} `,
+			`qingping_broker_bytes_received_total `,
+			`qingping_broker_clients_connected `,
+		}
+		for _, exp := range expected {
+			if !strings.Contains(body, exp) {
+				t.Fatalf(`Line not found in metrics: '%s'`, exp)
+			}
+		}
+	})
+
+	t.Run("readings endpoint", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		if err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage); err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		url := fmt.Sprintf(
+			"http://%s/api/devices/112233445566/readings?field=co2&from=1592190000&step=1h",
+			httpAddr,
+		)
+		body, err := httpGet(url)
+		if err != nil {
+			t.Fatalf("Failed to read readings: %v", err)
+		}
+		expected := `"points":[{"time":"2020-06-15T03:00:00Z","value":850}]`
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Unexpected readings: %s", body)
+		}
+
+		body, err = httpGet(url + "&format=csv")
+		if err != nil {
+			t.Fatalf("Failed to read readings: %v", err)
+		}
+		if body != "time,co2\n2020-06-15T03:00:00Z,850\n" {
+			t.Fatalf("Unexpected readings: %s", body)
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/devices/unknown/readings?field=co2", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to call readings endpoint: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("readings of converted fields", func(t *testing.T) {
+		conf := testConfig(t)
+		conf.Outputs.Units = map[string]UnitsConfig{"history": {Temperature: []string{UnitFahrenheit}}}
+		httpAddr, mqttAddr := startApp(t, conf, nil)
+
+		if err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage); err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		body, err := httpGet(fmt.Sprintf(
+			"http://%s/api/devices/112233445566/readings?field=temperature_fahrenheit&format=csv",
+			httpAddr,
+		))
+		if err != nil {
+			t.Fatalf("Failed to read readings: %v", err)
+		}
+		if body != "time,temperature_fahrenheit\n2020-06-15T03:40:53Z,74.3\n" {
+			t.Fatalf("Unexpected readings: %s", body)
+		}
+	})
+
+	t.Run("retransmitted message is dropped", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		if err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage); err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
 		message := `{
 			"type": "17",
 			"id": 12345,
@@ -76,12 +221,7 @@ func TestApp(t *testing.T) {
 			"timestamp": 1594815555,
 			"sensorData": [{
 				"timestamp": {"value": 1592192453},
-				"temperature": {"value": 23.5},
-				"humidity": {"value": 45.2},
-				"co2": {"value": 850},
-				"pm25": {"value": 12.3},
-				"pm10": {"value": 15.8},
-				"battery": {"value": 85}
+				"co2": {"value": 850}
 			}]
 		}`
 
@@ -100,18 +240,225 @@ func TestApp(t *testing.T) {
 
 		expected := []string{
 			`qingping_mqtt_messages_received_total{mac="112233445566",topic="qingping/test-device/up",type="17"} 1`,
-			`qingping_temperature_celsius{mac="112233445566"} 23.5`,
-			`qingping_humidity_percent{mac="112233445566"} 45.2`,
+			`qingping_mqtt_duplicates_total{kind="message"} 1`,
+		}
+		for _, exp := range expected {
+			if !strings.Contains(body, exp) {
+				t.Fatalf(`Line not found in metrics: '%s'`, exp)
+			}
+		}
+	})
+
+	t.Run("delayed history does not overwrite metrics", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		if err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage); err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		message := `{
+			"type": "17",
+			"id": 12346,
+			"mac": "112233445566",
+			"timestamp": 1594815555,
+			"sensorData": [{
+				"timestamp": {"value": 1592192000},
+				"co2": {"value": 700}
+			}]
+		}`
+
+		err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", message)
+		if err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/metrics", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read metrics: %v", err)
+		}
+		expected := []string{
 			`qingping_co2_ppm{mac="112233445566"} 850`,
+			`qingping_out_of_order_samples_total{mac="112233445566"} 1`,
 		}
 		for _, exp := range expected {
 			if !strings.Contains(body, exp) {
 				t.Fatalf(`Line not found in metrics: '%s'`, exp)
 			}
 		}
+
+		body, err = httpGet(fmt.Sprintf(
+			"http://%s/api/devices/112233445566/readings?field=co2&format=csv",
+			httpAddr,
+		))
+		if err != nil {
+			t.Fatalf("Failed to read readings: %v", err)
+		}
+		if !strings.Contains(body, "2020-06-15T03:33:20Z,700\n") {
+			t.Fatalf("Delayed sample not found in readings: %s", body)
+		}
+	})
+
+	t.Run("devices endpoint", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		if err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", historyMessage); err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/api/devices", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read devices: %v", err)
+		}
+		var resp DevicesResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("Failed to parse devices: %v", err)
+		}
+		if len(resp.Devices) != 1 {
+			t.Fatalf("Expected 1 device, got %s", body)
+		}
+		dev := resp.Devices[0]
+		if dev.MAC != "112233445566" || !dev.Online || dev.ClientID != "test-client" {
+			t.Fatalf("Unexpected device: %s", body)
+		}
+		if dev.Messages["17"] != 1 {
+			t.Fatalf("Expected 1 message of type 17, got %v", dev.Messages)
+		}
+		expected := LatestReading{Value: 850, Time: time.Unix(1592192453, 0)}
+		if co2 := dev.Readings["co2"]; co2.Value != expected.Value || !co2.Time.Equal(expected.Time) {
+			t.Fatalf("Expected latest co2 %v, got %v", expected, co2)
+		}
+
+		if _, err := httpGet(fmt.Sprintf("http://%s/api/devices/112233445566", httpAddr)); err != nil {
+			t.Fatalf("Failed to read device: %v", err)
+		}
+		resp2, err := http.Get(fmt.Sprintf("http://%s/api/devices/unknown", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to call device endpoint: %v", err)
+		}
+		defer resp2.Body.Close()
+		if resp2.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status 404, got %d", resp2.StatusCode)
+		}
+	})
+
+	t.Run("events endpoint", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Get(fmt.Sprintf(
+			"http://%s/api/events?mac=112233445566&type=reading,ack",
+			httpAddr,
+		))
+		if err != nil {
+			t.Fatalf("Failed to call events endpoint: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Unexpected content type: %s", ct)
+		}
+
+		message := `{
+			"type": "17",
+			"id": 12347,
+			"need_ack": 1,
+			"mac": "112233445566",
+			"timestamp": 1594815555,
+			"sensorData": [{
+				"timestamp": {"value": 1592192500},
+				"co2": {"value": 850}
+			}]
+		}`
+		err = sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", message)
+		if err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+
+		var events []string
+		scanner := bufio.NewScanner(resp.Body)
+		for len(events) < 2 && scanner.Scan() {
+			if typ, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events = append(events, typ)
+			}
+		}
+		expected := []string{EventReading, EventAck}
+		if !slices.Equal(events, expected) {
+			t.Fatalf("Expected events %v, got %v (%v)", expected, events, scanner.Err())
+		}
+
+		resp2, err := http.Get(fmt.Sprintf("http://%s/api/events?type=unknown", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to call events endpoint: %v", err)
+		}
+		defer resp2.Body.Close()
+		if resp2.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", resp2.StatusCode)
+		}
+	})
+
+	t.Run("clients endpoint", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(fmt.Sprintf("tcp://%s", mqttAddr))
+		opts.SetClientID("kicked-client")
+		opts.SetAutoReconnect(false)
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+			t.Fatalf("Failed to connect: %v", token.Error())
+		}
+		defer client.Disconnect(0)
+		if token := client.Subscribe("qingping/+/down", 0, nil); !token.WaitTimeout(2 * time.Second) {
+			t.Fatalf("Failed to subscribe")
+		}
+
+		body, err := httpGet(fmt.Sprintf("http://%s/api/clients", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read clients: %v", err)
+		}
+		var resp ClientsResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("Failed to parse clients: %v", err)
+		}
+		i := slices.IndexFunc(resp.Clients, func(c ClientInfo) bool { return c.ID == "kicked-client" })
+		if i < 0 || !resp.Clients[i].Connected || !slices.Equal(resp.Clients[i].Subscriptions, []string{"qingping/+/down"}) {
+			t.Fatalf("Client not found: %s", body)
+		}
+
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/api/clients/kicked-client", httpAddr), nil)
+		kick, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to kick client: %v", err)
+		}
+		kick.Body.Close()
+		if kick.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", kick.StatusCode)
+		}
+
+		// Wait for disconnection
+		time.Sleep(10 * time.Millisecond)
+		if client.IsConnectionOpen() {
+			t.Fatalf("Client is not disconnected")
+		}
+		body, err = httpGet(fmt.Sprintf("http://%s/metrics", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read metrics: %v", err)
+		}
+		expected := `qingping_mqtt_disconnections_total{listener="tcp",reason="kicked"} 1`
+		if !strings.Contains(body, expected) {
+			t.Fatalf(`Line not found in metrics: '%s'`, expected)
+		}
 	})
 
 	t.Run("invalid json message increments parse error counter", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
 		message := `{"invalid json syntax`
 
 		err := sendMQTTMessage(t, mqttAddr, "qingping/test-device/up", message)
@@ -132,7 +479,43 @@ func TestApp(t *testing.T) {
 		}
 	})
 
+	t.Run("invalid message is counted and processed", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
+		message := `{
+			"type": "12",
+			"id": 12350,
+			"mac": "AABBCCDDEEFF",
+			"sensorData": [{"humidity": {"value": 140}}]
+		}`
+
+		err := sendMQTTMessage(t, mqttAddr, "qingping/other-device/up", message)
+		if err != nil {
+			t.Fatalf("Failed to send MQTT message: %v", err)
+		}
+
+		// Wait for message processing
+		time.Sleep(10 * time.Millisecond)
+
+		body, err := httpGet(fmt.Sprintf("http://%s/metrics", httpAddr))
+		if err != nil {
+			t.Fatalf("Failed to read metrics: %v", err)
+		}
+		expected := []string{
+			`qingping_mqtt_invalid_messages_total{reason="value_out_of_range",type="12"} 1`,
+			// Lenient mode by default
+			`qingping_humidity_percent{mac="AABBCCDDEEFF"} 140`,
+		}
+		for _, exp := range expected {
+			if !strings.Contains(body, exp) {
+				t.Fatalf(`Line not found in metrics: '%s'`, exp)
+			}
+		}
+	})
+
 	t.Run("message without ack required", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
 		message := `{
 			"type": "17",
 			"id": 54321,
@@ -172,6 +555,8 @@ func TestApp(t *testing.T) {
 	})
 
 	t.Run("heartbeat message type 13", func(t *testing.T) {
+		httpAddr, mqttAddr := startApp(t, testConfig(t), nil)
+
 		message := `{
 			"type": "13",
 			"id": 11111,
@@ -200,6 +585,11 @@ func TestApp(t *testing.T) {
 	})
 
 	t.Run("heartbeat timeout resets metrics", func(t *testing.T) {
+		conf := testConfig(t)
+		// Set a short interval for testing
+		conf.Liveness.HeartbeatInterval = 50 * time.Millisecond
+		httpAddr, mqttAddr := startApp(t, conf, nil)
+
 		// Send initial data for device 1
 		msg := `{
 			"type": "17",
@@ -244,7 +634,7 @@ func TestApp(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to send heartbeat for device 1: %v", err)
 			}
-			time.Sleep(HeartbeatInterval)
+			time.Sleep(conf.Liveness.HeartbeatInterval)
 		}
 
 		// Check metrics
@@ -269,6 +659,196 @@ func TestApp(t *testing.T) {
 			t.Errorf("Expected device 2 humidity to be reset to 0")
 		}
 	})
+
+	t.Run("reload config", func(t *testing.T) {
+		conf := testConfig(t)
+		// Config returned on reload
+		next := conf
+		var loadErr error
+		load := func() (Config, error) { return next, loadErr }
+		httpAddr, mqttAddr := startApp(t, conf, load)
+
+		url := fmt.Sprintf("http://%s/api/admin/reload", httpAddr)
+
+		// Invalid config is rejected
+		next = conf
+		next.Pipeline.Workers = 0
+		if _, err := httpPost(url); err == nil || !strings.Contains(err.Error(), "400") {
+			t.Fatalf("Expected status 400, got %v", err)
+		}
+
+		// Failure to read config is a server error
+		loadErr = fmt.Errorf("read file: %w", os.ErrPermission)
+		if _, err := httpPost(url); err == nil || !strings.Contains(err.Error(), "500") {
+			t.Fatalf("Expected status 500, got %v", err)
+		}
+		loadErr = nil
+
+		// Clients must log in after users are added
+		next = conf
+		next.Auth.Users = []UserConfig{{Username: "device", Password: "secret"}}
+		body, err := httpPost(url)
+		if err != nil {
+			t.Fatalf("Failed to reload config: %v", err)
+		}
+		if !strings.Contains(body, `"auth.users: [] -\u003e [map[password:\u003credacted\u003e username:device]]"`) {
+			t.Errorf("Unexpected changes: %s", body)
+		}
+		err = sendMQTTMessage(t, mqttAddr, "qingping/device1/up", `{"type": "13", "wifi_mac": "MAC1"}`)
+		if err == nil {
+			t.Errorf("Expected anonymous client to be rejected")
+		}
+		if err := connectMQTT(mqttAddr, "device", "secret"); err != nil {
+			t.Errorf("Failed to log in: %v", err)
+		}
+
+		// Only the password is changed
+		next.Auth.Users = []UserConfig{{Username: "device", Password: "rotated"}}
+		body, err = httpPost(url)
+		if err != nil {
+			t.Fatalf("Failed to reload config: %v", err)
+		}
+		if !strings.Contains(body, `"auth.users: [map[password:\u003credacted\u003e username:device]] -\u003e `) ||
+			strings.Contains(body, "rotated") {
+			t.Errorf("Unexpected changes: %s", body)
+		}
+		if err := connectMQTT(mqttAddr, "device", "secret"); err == nil {
+			t.Errorf("Expected old password to be rejected")
+		}
+		if err := connectMQTT(mqttAddr, "device", "rotated"); err != nil {
+			t.Errorf("Failed to log in with new password: %v", err)
+		}
+
+		// Restore
+		next = conf
+		if _, err := httpPost(url); err != nil {
+			t.Fatalf("Failed to reload config: %v", err)
+		}
+		err = sendMQTTMessage(t, mqttAddr, "qingping/device1/up", `{"type": "13", "wifi_mac": "MAC1"}`)
+		if err != nil {
+			t.Errorf("Failed to send message after restoring config: %v", err)
+		}
+	})
+}
+
+func TestAppInstances(t *testing.T) {
+	// Every app has its own metrics, so they don't conflict
+	httpAddr1, mqttAddr1 := startApp(t, testConfig(t), nil)
+	httpAddr2, _ := startApp(t, testConfig(t), nil)
+
+	if err := sendMQTTMessage(t, mqttAddr1, "qingping/test-device/up", historyMessage); err != nil {
+		t.Fatalf("Failed to send MQTT message: %v", err)
+	}
+	// Wait for message processing
+	time.Sleep(10 * time.Millisecond)
+
+	expected := `qingping_co2_ppm{mac="112233445566"} 850`
+	body, err := httpGet(fmt.Sprintf("http://%s/metrics", httpAddr1))
+	if err != nil {
+		t.Fatalf("Failed to read metrics of app 1: %v", err)
+	}
+	if !strings.Contains(body, expected) {
+		t.Fatalf(`Line not found in metrics of app 1: '%s'`, expected)
+	}
+	body, err = httpGet(fmt.Sprintf("http://%s/metrics", httpAddr2))
+	if err != nil {
+		t.Fatalf("Failed to read metrics of app 2: %v", err)
+	}
+	if strings.Contains(body, "qingping_co2_ppm") {
+		t.Fatal("Unexpected device metrics in app 2")
+	}
+}
+
+func TestAppStopWritesQueuedMessages(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+	conf := testConfig(t)
+	app, err := NewApp(conf, nil, log)
+	if err != nil {
+		t.Fatalf("Failed to create app: %v", err)
+	}
+
+	// The context is canceled before the app is stopped, as in main
+	ctx, cancel := context.WithCancel(context.Background())
+	go app.Start(ctx) //nolint:errcheck
+	for range 100 {
+		if _, err := httpGet(fmt.Sprintf("http://%s/health", conf.Listeners.HTTP)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	// The message is still in the pipeline when the app is stopped
+	app.mqtt.pipeline.Push(Message{
+		Topic:    "qingping/test-device/up",
+		Payload:  []byte(historyMessage),
+		Received: time.Now(),
+	})
+	if err := app.Stop(); err != nil {
+		t.Fatalf("Failed to stop app: %v", err)
+	}
+
+	points, ok := app.env.History.Query("112233445566", "co2", time.Time{}, time.Time{})
+	if !ok || len(points) != 1 || points[0].Value != 850 {
+		t.Fatalf("Queued message is not written: %v", points)
+	}
+}
+
+// testConfig returns the default configuration with listeners
+// on free ports.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+
+	// Keep both ports busy until both are picked, so they differ
+	var addrs [2]string
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find free port: %v", err)
+		}
+		defer l.Close()
+		addrs[i] = l.Addr().String()
+	}
+
+	conf := DefaultConfig()
+	conf.Listeners.HTTP = addrs[0]
+	conf.Listeners.MQTT = addrs[1]
+	return conf
+}
+
+// startApp starts the application and stops it at the end of the test.
+// Returns HTTP and MQTT addresses.
+func startApp(t *testing.T, conf Config, load LoadFunc) (string, string) {
+	t.Helper()
+
+	log := logrus.New()
+	log.Out = io.Discard
+
+	app, err := NewApp(conf, load, log)
+	if err != nil {
+		t.Fatalf("Failed to create app: %v", err)
+	}
+	go func() {
+		if err := app.Start(context.Background()); err != nil {
+			t.Errorf("Failed to start app: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		if err := app.Stop(); err != nil {
+			t.Errorf("Failed to stop app: %v", err)
+		}
+	})
+
+	// Wait for services to start
+	for range 100 {
+		if _, err := httpGet(fmt.Sprintf("http://%s/health", conf.Listeners.HTTP)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conf.Listeners.HTTP, conf.Listeners.MQTT
 }
 
 func httpGet(url string) (string, error) {
@@ -286,6 +866,23 @@ func httpGet(url string) (string, error) {
 	return string(body), nil
 }
 
+func httpPost(url string) (string, error) {
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		return "", fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
 func sendMQTTMessage(t *testing.T, addr, topic, payload string) error {
 	t.Helper()
 
@@ -316,3 +913,25 @@ func sendMQTTMessage(t *testing.T, addr, topic, payload string) error {
 
 	return nil
 }
+
+// connectMQTT connects to the broker with credentials and disconnects.
+func connectMQTT(addr, username, password string) error {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", addr))
+	opts.SetClientID("test-login")
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetConnectTimeout(2 * time.Second)
+	opts.SetAutoReconnect(false)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("connection timeout")
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// aclAccess maps access names used in the configuration to
+// access levels of the broker.
+var aclAccess = map[string]auth.Access{
+	"deny":      auth.Deny,
+	"read":      auth.ReadOnly,
+	"write":     auth.WriteOnly,
+	"readwrite": auth.ReadWrite,
+}
+
+// AuthHook checks MQTT clients against auth rules. Unlike auth.Hook,
+// rules can be replaced while clients are connected.
+type AuthHook struct {
+	mqtt.HookBase
+	ledger atomic.Pointer[auth.Ledger]
+}
+
+// NewAuthHook creates a new auth hook.
+func NewAuthHook(conf AuthConfig) *AuthHook {
+	h := &AuthHook{}
+	h.Set(conf)
+	return h
+}
+
+// Set replaces auth rules. New rules apply to the next connect,
+// publish or subscribe.
+func (h *AuthHook) Set(conf AuthConfig) {
+	h.ledger.Store(NewAuthLedger(conf))
+}
+
+// ID returns the ID of the hook.
+func (h *AuthHook) ID() string {
+	return "auth"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *AuthHook) Provides(flag byte) bool {
+	return flag == mqtt.OnConnectAuthenticate || flag == mqtt.OnACLCheck
+}
+
+// OnConnectAuthenticate returns true if the client is allowed to connect.
+func (h *AuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	_, ok := h.ledger.Load().AuthOk(cl, pk)
+	return ok
+}
+
+// OnACLCheck returns true if the client is allowed to read or write
+// the topic.
+func (h *AuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	_, ok := h.ledger.Load().ACLOk(cl, topic, write)
+	return ok
+}
+
+// NewAuthLedger creates rules for MQTT clients. When there are no users,
+// all clients are allowed. Otherwise clients must log in, and have full
+// access unless restricted by ACL.
+func NewAuthLedger(conf AuthConfig) *auth.Ledger {
+	if len(conf.Users) == 0 {
+		return &auth.Ledger{Auth: auth.AuthRules{{Allow: true}}}
+	}
+
+	ledger := &auth.Ledger{}
+	for _, u := range conf.Users {
+		ledger.Auth = append(ledger.Auth, auth.AuthRule{
+			Username: auth.RString(u.Username),
+			Password: auth.RString(u.Password),
+			Allow:    true,
+		})
+	}
+	for _, acl := range conf.ACL {
+		filters := auth.Filters{}
+		for filter, access := range acl.Filters {
+			filters[auth.RString(filter)] = aclAccess[access]
+		}
+		ledger.ACL = append(ledger.ACL, auth.ACLRule{
+			Username: auth.RString(acl.Username),
+			Filters:  filters,
+		})
+	}
+	return ledger
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BrokerCollector exposes statistics of the MQTT server. Values are read
+// on scrape.
+type BrokerCollector struct {
+	server *mqtt.Server
+}
+
+// NewBrokerCollector creates a collector of the server statistics.
+func NewBrokerCollector(server *mqtt.Server) *BrokerCollector {
+	return &BrokerCollector{server: server}
+}
+
+var brokerDescs = struct {
+	uptime, bytesReceived, bytesSent, messagesReceived, messagesSent, messagesDropped,
+	retained, inflight, inflightDropped, subscriptions,
+	clientsConnected, clientsTotal, clientsMaximum *prometheus.Desc
+}{
+	uptime:           brokerDesc("uptime_seconds", "Time since the broker started"),
+	bytesReceived:    brokerDesc("bytes_received_total", "Total number of bytes received"),
+	bytesSent:        brokerDesc("bytes_sent_total", "Total number of bytes sent"),
+	messagesReceived: brokerDesc("messages_received_total", "Total number of publish messages received"),
+	messagesSent:     brokerDesc("messages_sent_total", "Total number of publish messages sent"),
+	messagesDropped:  brokerDesc("messages_dropped_total", "Total number of publish messages dropped to slow subscribers"),
+	retained:         brokerDesc("retained_messages", "Number of retained messages"),
+	inflight:         brokerDesc("inflight_messages", "Number of messages currently in-flight"),
+	inflightDropped:  brokerDesc("inflight_dropped_total", "Total number of in-flight messages dropped"),
+	subscriptions:    brokerDesc("subscriptions", "Number of active subscriptions"),
+	clientsConnected: brokerDesc("clients_connected", "Number of currently connected clients"),
+	clientsTotal:     brokerDesc("clients", "Number of connected clients and kept sessions of disconnected ones"),
+	clientsMaximum:   brokerDesc("clients_maximum", "Maximum number of simultaneously connected clients"),
+}
+
+func brokerDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc("qingping_broker_"+name, help, nil, nil)
+}
+
+// Describe sends descriptions of all metrics.
+func (c *BrokerCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect reads the server statistics.
+func (c *BrokerCollector) Collect(ch chan<- prometheus.Metric) {
+	info := c.server.Info.Clone()
+	d := brokerDescs
+
+	counter := func(desc *prometheus.Desc, v int64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v))
+	}
+	gauge := func(desc *prometheus.Desc, v int64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+	}
+
+	var uptime time.Duration
+	if info.Started > 0 {
+		uptime = time.Since(time.Unix(info.Started, 0))
+	}
+	ch <- prometheus.MustNewConstMetric(d.uptime, prometheus.GaugeValue, uptime.Seconds())
+	counter(d.bytesReceived, info.BytesReceived)
+	counter(d.bytesSent, info.BytesSent)
+	counter(d.messagesReceived, info.MessagesReceived)
+	counter(d.messagesSent, info.MessagesSent)
+	counter(d.messagesDropped, info.MessagesDropped)
+	gauge(d.retained, info.Retained)
+	gauge(d.inflight, info.Inflight)
+	counter(d.inflightDropped, info.InflightDropped)
+	gauge(d.subscriptions, info.Subscriptions)
+	gauge(d.clientsConnected, info.ClientsConnected)
+	// Total number is updated by the server only periodically
+	gauge(d.clientsTotal, int64(c.server.Clients.Len()))
+	gauge(d.clientsMaximum, info.ClientsMaximum)
+}
+
+// PacketsHook counts packets by type.
+type PacketsHook struct {
+	mqtt.HookBase
+	metrics *Metrics
+}
+
+// ID returns the ID of the hook.
+func (h *PacketsHook) ID() string {
+	return "packets"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *PacketsHook) Provides(flag byte) bool {
+	return flag == mqtt.OnPacketRead || flag == mqtt.OnPacketSent
+}
+
+// OnPacketRead is called when a packet is received from a client.
+func (h *PacketsHook) OnPacketRead(_ *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.metrics.PacketsCounter.WithLabelValues("received", packetType(pk)).Inc()
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet is written to a client.
+func (h *PacketsHook) OnPacketSent(_ *mqtt.Client, pk packets.Packet, _ []byte) {
+	h.metrics.PacketsCounter.WithLabelValues("sent", packetType(pk)).Inc()
+}
+
+// packetType returns the lowercase name of the packet type.
+func packetType(pk packets.Packet) string {
+	name, ok := packets.PacketNames[pk.FixedHeader.Type]
+	if !ok {
+		return "unknown"
+	}
+	return strings.ToLower(name)
+}
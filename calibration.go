@@ -0,0 +1,77 @@
+package main
+
+import (
+	"maps"
+	"sync"
+)
+
+// RawSuffix is added to names of fields with original values,
+// when they are exported alongside calibrated ones.
+const RawSuffix = "_raw"
+
+// Calibrator corrects sensor values of readings by device model and MAC.
+type Calibrator struct {
+	conf    CalibrationConfig
+	devices Devices
+	mx      sync.RWMutex
+}
+
+// NewCalibrator creates a new calibrator.
+func NewCalibrator(conf Config) *Calibrator {
+	c := &Calibrator{}
+	c.SetConfig(conf)
+	return c
+}
+
+// SetConfig replaces calibration settings and the device registry.
+func (c *Calibrator) SetConfig(conf Config) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.conf = conf.Calibration
+	c.devices = conf.Devices
+}
+
+// Apply corrects values of the readings in place.
+func (c *Calibrator) Apply(readings []Reading) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	for i, r := range readings {
+		model := c.conf.Models[c.devices.Get(r.MAC).Model]
+		device := c.conf.Devices[r.MAC]
+		if len(model) == 0 && len(device) == 0 {
+			continue
+		}
+
+		fields := maps.Clone(r.Fields)
+		for field, value := range r.Fields {
+			fc, ok := device[field]
+			if !ok {
+				fc, ok = model[field]
+			}
+			if !ok {
+				continue
+			}
+			fields[field] = fc.Apply(value)
+			if c.conf.ExportRaw {
+				fields[field+RawSuffix] = value
+			}
+		}
+		readings[i].Fields = fields
+	}
+}
+
+// Apply returns the corrected value.
+func (fc FieldCalibration) Apply(value float64) float64 {
+	if fc.Factor != 0 {
+		value *= fc.Factor
+	}
+	value += fc.Offset
+	if fc.Min != nil {
+		value = max(value, *fc.Min)
+	}
+	if fc.Max != nil {
+		value = min(value, *fc.Max)
+	}
+	return value
+}
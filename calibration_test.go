@@ -0,0 +1,61 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestCalibratorApply(t *testing.T) {
+	limit := func(v float64) *float64 { return &v }
+
+	conf := DefaultConfig()
+	conf.Devices = Devices{
+		"MAC1": {Name: "office", Model: "CGDN1"},
+		"MAC2": {Name: "bedroom", Model: "CGDN1"},
+		"MAC3": {Name: "kitchen", Model: "CGS1"},
+	}
+	conf.Calibration = CalibrationConfig{
+		Models: map[string]Calibration{
+			"CGDN1": {
+				"temperature": {Offset: -0.8},
+				"humidity":    {Factor: 1.1, Max: limit(100)},
+			},
+		},
+		Devices: map[string]Calibration{
+			"MAC2": {
+				"temperature": {Offset: -0.5},
+				"co2":         {Offset: -60, Min: limit(400)},
+			},
+		},
+		ExportRaw: true,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	readings := []Reading{
+		{MAC: "MAC1", Fields: map[string]float64{"temperature": 23, "humidity": 95, "co2": 800}},
+		{MAC: "MAC2", Fields: map[string]float64{"temperature": 23, "humidity": 50, "co2": 430}},
+		{MAC: "MAC3", Fields: map[string]float64{"temperature": 23}},
+	}
+	NewCalibrator(conf).Apply(readings)
+
+	expected := []map[string]float64{
+		{
+			"temperature": 22.2, "temperature_raw": 23,
+			"humidity": 100, "humidity_raw": 95,
+			"co2": 800,
+		},
+		{
+			"temperature": 22.5, "temperature_raw": 23,
+			"humidity": 55, "humidity_raw": 50,
+			"co2": 400, "co2_raw": 430,
+		},
+		{"temperature": 23},
+	}
+	for i, r := range readings {
+		if !maps.EqualFunc(r.Fields, expected[i], func(a, b float64) bool { return a-b < 1e-9 && b-a < 1e-9 }) {
+			t.Errorf("Reading %s: expected %v, got %v", r.MAC, expected[i], r.Fields)
+		}
+	}
+}
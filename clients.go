@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Reasons of client disconnections.
+const (
+	DisconnectNormal        = "normal"
+	DisconnectClosed        = "connection_closed"
+	DisconnectKeepalive     = "keepalive_timeout"
+	DisconnectTakenOver     = "session_taken_over"
+	DisconnectKicked        = "kicked"
+	DisconnectShutdown      = "shutdown"
+	DisconnectProtocolError = "protocol_error"
+)
+
+// ErrClientNotFound is returned for unknown client IDs.
+var ErrClientNotFound = errors.New("client not found")
+
+// ClientInfo describes an MQTT client session.
+type ClientInfo struct {
+	ID              string   `json:"id"`
+	Listener        string   `json:"listener"`
+	RemoteAddr      string   `json:"remote_addr"`
+	Username        string   `json:"username,omitempty"`
+	ProtocolVersion byte     `json:"protocol_version"`
+	CleanSession    bool     `json:"clean_session"`
+	Keepalive       uint16   `json:"keepalive"` // seconds
+	Subscriptions   []string `json:"subscriptions"`
+	Connected       bool     `json:"connected"` // false for kept sessions of disconnected clients
+}
+
+// Clients returns sessions of all clients sorted by ID.
+func (b *MQTTBroker) Clients() []ClientInfo {
+	all := b.server.Clients.GetAll()
+	list := make([]ClientInfo, 0, len(all))
+	for _, cl := range all {
+		if cl.Net.Inline {
+			continue
+		}
+		list = append(list, clientInfo(cl))
+	}
+	slices.SortFunc(list, func(a, b ClientInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// Kick disconnects the client.
+func (b *MQTTBroker) Kick(id string) error {
+	cl, ok := b.server.Clients.Get(id)
+	if !ok || cl.Net.Inline {
+		return ErrClientNotFound
+	}
+	// Only MQTT 5 supports disconnect packets from the server
+	if cl.Properties.ProtocolVersion == 5 {
+		// The reason code is returned as is when the client is stopped
+		err := b.server.DisconnectClient(cl, packets.ErrAdministrativeAction)
+		if err != nil && !errors.Is(err, packets.ErrAdministrativeAction) {
+			return fmt.Errorf("disconnect client: %w", err)
+		}
+		return nil
+	}
+	cl.Stop(packets.ErrAdministrativeAction)
+	return nil
+}
+
+func clientInfo(cl *mqtt.Client) ClientInfo {
+	subs := cl.State.Subscriptions.GetAll()
+	filters := make([]string, 0, len(subs))
+	for filter := range subs {
+		filters = append(filters, filter)
+	}
+	slices.Sort(filters)
+
+	return ClientInfo{
+		ID:              cl.ID,
+		Listener:        cl.Net.Listener,
+		RemoteAddr:      cl.Net.Remote,
+		Username:        string(cl.Properties.Username),
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		CleanSession:    cl.Properties.Clean,
+		Keepalive:       cl.State.Keepalive,
+		Subscriptions:   filters,
+		Connected:       !cl.Closed(),
+	}
+}
+
+// ConnectionsHook counts client connections and disconnections.
+type ConnectionsHook struct {
+	mqtt.HookBase
+	metrics *Metrics
+}
+
+// ID returns the ID of the hook.
+func (h *ConnectionsHook) ID() string {
+	return "connections"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *ConnectionsHook) Provides(flag byte) bool {
+	return flag == mqtt.OnSessionEstablished || flag == mqtt.OnDisconnect
+}
+
+// OnSessionEstablished is called when a client is authenticated
+// and its session is ready.
+func (h *ConnectionsHook) OnSessionEstablished(cl *mqtt.Client, _ packets.Packet) {
+	if cl.Net.Inline {
+		return
+	}
+	h.metrics.ConnectionsCounter.WithLabelValues(cl.Net.Listener).Inc()
+	h.metrics.ConnectedClientsGauge.WithLabelValues(cl.Net.Listener).Inc()
+}
+
+// OnDisconnect is called when a client is disconnected.
+func (h *ConnectionsHook) OnDisconnect(cl *mqtt.Client, err error, _ bool) {
+	if cl.Net.Inline {
+		return
+	}
+	// The first cause of stopping is more precise than the error
+	// of reading from the closed connection
+	if cause := cl.StopCause(); cause != nil {
+		err = cause
+	}
+	h.metrics.DisconnectionsCounter.WithLabelValues(cl.Net.Listener, disconnectReason(err)).Inc()
+	h.metrics.ConnectedClientsGauge.WithLabelValues(cl.Net.Listener).Dec()
+}
+
+// disconnectReason classifies the cause of disconnection.
+func disconnectReason(err error) string {
+	var code packets.Code
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return DisconnectNormal
+	case errors.As(err, &code):
+		switch code.Code {
+		case packets.CodeDisconnect.Code, packets.CodeDisconnectWillMessage.Code:
+			return DisconnectNormal
+		case packets.ErrKeepAliveTimeout.Code:
+			return DisconnectKeepalive
+		case packets.ErrSessionTakenOver.Code:
+			return DisconnectTakenOver
+		case packets.ErrAdministrativeAction.Code:
+			return DisconnectKicked
+		case packets.ErrServerShuttingDown.Code:
+			return DisconnectShutdown
+		default:
+			return DisconnectProtocolError
+		}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DisconnectKeepalive
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.As(err, &netErr):
+		return DisconnectClosed
+	default:
+		return DisconnectProtocolError
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: DisconnectNormal},
+		{err: packets.CodeDisconnect, expected: DisconnectNormal},
+		{err: packets.ErrKeepAliveTimeout, expected: DisconnectKeepalive},
+		{err: packets.ErrSessionTakenOver, expected: DisconnectTakenOver},
+		{err: packets.ErrAdministrativeAction, expected: DisconnectKicked},
+		{err: packets.ErrServerShuttingDown, expected: DisconnectShutdown},
+		{err: packets.ErrMalformedPacket, expected: DisconnectProtocolError},
+		{err: fmt.Errorf("read: %w", io.EOF), expected: DisconnectClosed},
+		{err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, expected: DisconnectKeepalive},
+	}
+	for _, tc := range testCases {
+		if reason := disconnectReason(tc.err); reason != tc.expected {
+			t.Errorf("Error '%v': expected %s, got %s", tc.err, tc.expected, reason)
+		}
+	}
+}
+
+func TestKick(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	// Errors of writing the disconnect packet are only returned
+	// in passive mode
+	server.Options.Capabilities.Compatibilities.PassiveClientDisconnect = true
+	broker := &MQTTBroker{server: server}
+
+	cl := server.NewClient(nil, "tcp", "closed-client", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Stop(nil)
+	server.Clients.Add(cl)
+
+	t.Run("unknown client", func(t *testing.T) {
+		if err := broker.Kick("unknown"); !errors.Is(err, ErrClientNotFound) {
+			t.Fatalf("Expected ErrClientNotFound, got %v", err)
+		}
+	})
+
+	t.Run("disconnect error", func(t *testing.T) {
+		err := broker.Kick("closed-client")
+		if err == nil || errors.Is(err, ErrClientNotFound) {
+			t.Fatalf("Expected disconnect error, got %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/clients/closed-client", nil)
+		req.SetPathValue("id", "closed-client")
+		rec := httptest.NewRecorder()
+		KickClientHandler(broker).ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected status 500, got %d", rec.Code)
+		}
+	})
+}
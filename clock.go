@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+// Policies for samples with implausible timestamps.
+const (
+	ClockPolicyKeep    = "keep"    // use timestamps as is
+	ClockPolicyCorrect = "correct" // shift timestamps by the measured skew
+	ClockPolicyReject  = "reject"  // drop samples
+)
+
+// MinValidTime is the earliest plausible device timestamp. Devices
+// with a reset clock report time starting from 1970.
+var MinValidTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ClockMonitor measures skew of device clocks against server time
+// and fixes sample timestamps according to the policy.
+type ClockMonitor struct {
+	conf    ClockConfig
+	synced  map[string]time.Time // last time sync per device
+	metrics *Metrics
+	mx      sync.Mutex
+}
+
+// NewClockMonitor creates a new clock monitor.
+func NewClockMonitor(conf ClockConfig, metrics *Metrics) *ClockMonitor {
+	return &ClockMonitor{
+		conf:    conf,
+		synced:  make(map[string]time.Time),
+		metrics: metrics,
+	}
+}
+
+// Skew measures the difference between server time and device time from
+// the message timestamp, and exports it as a metric. Positive skew means
+// device clock is behind. The second value is false when the message has
+// no timestamp.
+func (c *ClockMonitor) Skew(mac string, timestamp int64, now time.Time) (time.Duration, bool) {
+	if timestamp <= 0 {
+		return 0, false
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	c.metrics.ClockSkewGauge.WithLabelValues(mac).Set(skew.Seconds())
+	return skew, true
+}
+
+// NeedSync reports whether the time sync command should be sent to
+// the device. Commands are sent not more often than once per sync interval.
+func (c *ClockMonitor) NeedSync(mac string, skew time.Duration, now time.Time) bool {
+	if !c.conf.TimeSync || !c.exceeds(skew) {
+		return false
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if now.Sub(c.synced[mac]) < c.conf.SyncInterval {
+		return false
+	}
+	c.synced[mac] = now
+	return true
+}
+
+// Fix applies the policy to the samples of the device. Skew is the value
+// measured from the message, measured is false if the message has
+// no timestamp.
+func (c *ClockMonitor) Fix(
+	data []qingping.SensorData,
+	skew time.Duration,
+	measured bool,
+	now time.Time,
+) []qingping.SensorData {
+	if c.conf.Policy == ClockPolicyKeep || c.conf.Policy == "" {
+		return data
+	}
+
+	fixed := make([]qingping.SensorData, 0, len(data))
+	for _, d := range data {
+		if d.Timestamp.Value <= 0 {
+			fixed = append(fixed, d)
+			continue
+		}
+		t := time.Unix(int64(d.Timestamp.Value), 0)
+		bad := (measured && c.exceeds(skew)) || !c.plausible(t, now)
+		if !bad {
+			fixed = append(fixed, d)
+			continue
+		}
+
+		if c.conf.Policy == ClockPolicyReject {
+			c.metrics.ClockFixedCounter.WithLabelValues("rejected").Inc()
+			continue
+		}
+		// Shift by the measured skew, or use server time if the device
+		// time is unknown or the shifted time is still implausible
+		if measured {
+			t = t.Add(skew)
+		}
+		if !measured || !c.plausible(t, now) {
+			t = now
+		}
+		d.Timestamp.Value = float64(t.Unix())
+		c.metrics.ClockFixedCounter.WithLabelValues("corrected").Inc()
+		fixed = append(fixed, d)
+	}
+	return fixed
+}
+
+// exceeds reports whether the skew is above the threshold.
+func (c *ClockMonitor) exceeds(skew time.Duration) bool {
+	return math.Abs(skew.Seconds()) > c.conf.MaxSkew.Seconds()
+}
+
+// plausible reports whether the sample timestamp can be real.
+func (c *ClockMonitor) plausible(t, now time.Time) bool {
+	return !t.Before(MinValidTime) && !t.After(now.Add(c.conf.MaxSkew))
+}
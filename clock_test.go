@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+func TestClockMonitorFix(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sample := func(ts int64) qingping.SensorData {
+		return qingping.SensorData{Timestamp: qingping.Value{Value: float64(ts), Valid: true}}
+	}
+
+	testCases := []struct {
+		name     string
+		policy   string
+		skew     time.Duration
+		measured bool
+		data     []qingping.SensorData
+		expected []int64
+	}{
+		{
+			name:     "keep",
+			policy:   ClockPolicyKeep,
+			skew:     time.Hour,
+			measured: true,
+			data:     []qingping.SensorData{sample(1699996400)},
+			expected: []int64{1699996400},
+		},
+		{
+			name:     "correct skewed clock",
+			policy:   ClockPolicyCorrect,
+			skew:     time.Hour,
+			measured: true,
+			data:     []qingping.SensorData{sample(1699996400)},
+			expected: []int64{1700000000},
+		},
+		{
+			name:     "correct reset clock without message timestamp",
+			policy:   ClockPolicyCorrect,
+			data:     []qingping.SensorData{sample(100)},
+			expected: []int64{1700000000},
+		},
+		{
+			name:     "correct implausible after shift",
+			policy:   ClockPolicyCorrect,
+			skew:     time.Hour,
+			measured: true,
+			data:     []qingping.SensorData{sample(100)},
+			expected: []int64{1700000000},
+		},
+		{
+			name:     "reject reset clock",
+			policy:   ClockPolicyReject,
+			data:     []qingping.SensorData{sample(100), sample(1699999940)},
+			expected: []int64{1699999940},
+		},
+		{
+			name:     "reject future",
+			policy:   ClockPolicyReject,
+			skew:     time.Minute,
+			measured: true,
+			data:     []qingping.SensorData{sample(1700003600), sample(1699999940)},
+			expected: []int64{1699999940},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewClockMonitor(ClockConfig{Policy: tc.policy, MaxSkew: 5 * time.Minute}, NewMetrics(MetricsConfig{}))
+			fixed := c.Fix(tc.data, tc.skew, tc.measured, now)
+			if len(fixed) != len(tc.expected) {
+				t.Fatalf("Expected %d samples, got %d", len(tc.expected), len(fixed))
+			}
+			for i, d := range fixed {
+				if int64(d.Timestamp.Value) != tc.expected[i] {
+					t.Errorf("Expected timestamp %d, got %d", tc.expected[i], int64(d.Timestamp.Value))
+				}
+			}
+		})
+	}
+}
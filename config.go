@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+// EnvPrefix is the prefix of environment variables that override
+// configuration values. Variable name is built from the path of yaml keys,
+// e.g. QINGPING_OUTPUTS_REMOTE_WRITE_URL.
+const EnvPrefix = "QINGPING"
+
+// redacted replaces secrets in printed configuration.
+const redacted = "<redacted>"
+
+// Config is the application configuration.
+type Config struct {
+	Listeners   ListenersConfig   `yaml:"listeners"`
+	Auth        AuthConfig        `yaml:"auth"`
+	HTTP        HTTPConfig        `yaml:"http"`
+	Devices     Devices           `yaml:"devices"`
+	Calibration CalibrationConfig `yaml:"calibration"`
+	Pipeline    PipelineConfig    `yaml:"pipeline"`
+	Clock       ClockConfig       `yaml:"clock"`
+	Liveness    LivenessConfig    `yaml:"liveness"`
+	Outputs     OutputsConfig     `yaml:"outputs"`
+	Alerts      AlertsConfig      `yaml:"alerts"`
+	Health      HealthConfig      `yaml:"health"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Logging     LoggingConfig     `yaml:"logging"`
+}
+
+// ListenersConfig contains listen addresses of the servers.
+type ListenersConfig struct {
+	HTTP string `yaml:"http"`
+	MQTT string `yaml:"mqtt"`
+}
+
+// AuthConfig is the configuration of MQTT clients authentication and
+// authorization. All clients are allowed when there are no users.
+type AuthConfig struct {
+	Users []UserConfig `yaml:"users"`
+	ACL   []ACLConfig  `yaml:"acl"`
+}
+
+// UserConfig contains credentials of an MQTT user.
+type UserConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ACLConfig restricts access of a user to topics. Filters map topic
+// filters to access: deny, read, write, readwrite.
+type ACLConfig struct {
+	Username string            `yaml:"username"`
+	Filters  map[string]string `yaml:"filters"`
+}
+
+// HTTPConfig is the configuration of the HTTP server.
+type HTTPConfig struct {
+	TLS  TLSConfig      `yaml:"tls"`
+	Auth HTTPAuthConfig `yaml:"auth"`
+}
+
+// TLSConfig contains paths to a certificate and its key. TLS is disabled
+// when they are empty.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Enabled checks if TLS is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// HTTPAuthConfig is the configuration of HTTP API authentication. API is
+// open when there are no tokens and users.
+type HTTPAuthConfig struct {
+	Tokens  []TokenConfig    `yaml:"tokens"`
+	Users   []HTTPUserConfig `yaml:"users"`
+	Metrics bool             `yaml:"metrics"` // require authentication for /metrics
+}
+
+// TokenConfig is a bearer token with its scope: read or admin.
+type TokenConfig struct {
+	Token string `yaml:"token"`
+	Scope string `yaml:"scope"`
+}
+
+// HTTPUserConfig contains basic auth credentials with their scope:
+// read or admin.
+type HTTPUserConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Scope    string `yaml:"scope"`
+}
+
+// CalibrationConfig contains corrections of sensor values by device
+// model and by device MAC. Settings of a field for a device replace
+// settings of the same field for its model.
+type CalibrationConfig struct {
+	Models    map[string]Calibration `yaml:"models"`
+	Devices   map[string]Calibration `yaml:"devices"`
+	ExportRaw bool                   `yaml:"export_raw"` // keep original values in <field>_raw fields
+}
+
+// Calibration maps sensor names to their corrections.
+type Calibration map[string]FieldCalibration
+
+// FieldCalibration is a correction of a sensor value:
+// value*factor + offset, clamped to [min, max].
+type FieldCalibration struct {
+	Offset float64  `yaml:"offset"`
+	Factor float64  `yaml:"factor"` // 1 if not set
+	Min    *float64 `yaml:"min"`
+	Max    *float64 `yaml:"max"`
+}
+
+// PipelineConfig is the configuration of processing of MQTT messages.
+// Messages are assigned to workers by topic, so the order of messages
+// of a device is kept as long as it publishes to a single topic.
+type PipelineConfig struct {
+	Workers     int           `yaml:"workers"`      // number of messages processed in parallel
+	QueueSize   int           `yaml:"queue_size"`   // max number of messages waiting to be processed
+	DedupWindow time.Duration `yaml:"dedup_window"` // time to remember seen messages, 0 to disable deduplication
+	Validation  string        `yaml:"validation"`   // what to do with invalid messages: lenient, strict
+}
+
+// ClockConfig is the configuration of device clock checks.
+type ClockConfig struct {
+	Policy       string        `yaml:"policy"`        // what to do with implausible timestamps: keep, correct, reject
+	MaxSkew      time.Duration `yaml:"max_skew"`      // max allowed difference between device and server time
+	TimeSync     bool          `yaml:"time_sync"`     // send time sync command when skew exceeds MaxSkew
+	SyncInterval time.Duration `yaml:"sync_interval"` // min interval between time sync commands to a device
+}
+
+// LivenessConfig defines when a device is considered gone.
+type LivenessConfig struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // expected interval of heartbeats from devices
+	MissedHeartbeats  int           `yaml:"missed_heartbeats"`  // number of missed heartbeats to consider device gone
+}
+
+// Timeout returns time since the last message after which the device
+// is considered gone.
+func (c LivenessConfig) Timeout() time.Duration {
+	return time.Duration(c.MissedHeartbeats) * c.HeartbeatInterval
+}
+
+// HealthConfig defines when the service is not ready.
+type HealthConfig struct {
+	MaxSinkErrorRate float64       `yaml:"max_sink_error_rate"` // share of failed recent batches of a sink, 0 to 1
+	MaxMessageAge    time.Duration `yaml:"max_message_age"`     // max time since the last message, 0 to disable
+}
+
+// MetricsConfig is the configuration of exposed metrics.
+type MetricsConfig struct {
+	Runtime bool `yaml:"runtime"` // expose Go runtime and process metrics
+}
+
+// OutputsConfig is the configuration of sinks.
+type OutputsConfig struct {
+	Sinks       []string               `yaml:"sinks"` // names of enabled sinks, see SinkRegistry
+	Units       map[string]UnitsConfig `yaml:"units"` // units of values by sink name, native units by default
+	MQTT        RepublishConfig        `yaml:"mqtt"`
+	File        FileConfig             `yaml:"file"`
+	RemoteWrite RemoteWriteConfig      `yaml:"remote_write"`
+	InfluxDB    InfluxConfig           `yaml:"influxdb"`
+}
+
+// UnitsConfig selects units of values written to a sink. Values can be
+// written in several units at once, empty list means the native unit.
+type UnitsConfig struct {
+	Temperature []string `yaml:"temperature"` // celsius, fahrenheit
+	TVOC        []string `yaml:"tvoc"`        // ppb, ugm3
+	Radon       []string `yaml:"radon"`       // bqm3, pcil
+}
+
+// RepublishConfig is the configuration of the sink that publishes
+// readings back to the MQTT broker.
+type RepublishConfig struct {
+	Topic string `yaml:"topic"` // topic prefix, MAC address is added to it
+}
+
+// FileConfig is the configuration of the sink that appends readings
+// to a file.
+type FileConfig struct {
+	Path string `yaml:"path"`
+}
+
+// RemoteWriteConfig is the configuration of Prometheus remote write output.
+type RemoteWriteConfig struct {
+	URL         string `yaml:"url"`
+	BatchConfig `yaml:",inline"`
+}
+
+// InfluxConfig is the configuration of InfluxDB output.
+type InfluxConfig struct {
+	URL         string `yaml:"url"`
+	Org         string `yaml:"org"`
+	Bucket      string `yaml:"bucket"`
+	Token       string `yaml:"token"`
+	BatchConfig `yaml:",inline"`
+}
+
+// BatchConfig is the configuration of sending samples in batches.
+type BatchConfig struct {
+	BatchSize     int           `yaml:"batch_size"`     // max number of readings in a batch
+	QueueSize     int           `yaml:"queue_size"`     // max number of readings waiting to be sent
+	FlushInterval time.Duration `yaml:"flush_interval"` // interval of sending incomplete batches, 0 to send immediately
+}
+
+// AlertsConfig is the configuration of built-in alerting.
+type AlertsConfig struct {
+	CheckInterval time.Duration   `yaml:"check_interval"` // interval of checking offline devices
+	Rules         []AlertRule     `yaml:"rules"`
+	Webhooks      []WebhookConfig `yaml:"webhooks"`
+}
+
+// AlertRule fires when a sensor value crosses the threshold for the given
+// duration, or when a device sends nothing for the offline duration.
+type AlertRule struct {
+	Name       string        `yaml:"name"`
+	Match      DeviceMatch   `yaml:"match"`      // devices the rule applies to, all by default
+	Field      string        `yaml:"field"`      // sensor name, see qingping.SensorFields
+	Op         string        `yaml:"op"`         // comparison: >, >=, <, <=
+	Threshold  float64       `yaml:"threshold"`  // value compared to the sensor value
+	Hysteresis float64       `yaml:"hysteresis"` // margin past the threshold to resolve the alert
+	For        time.Duration `yaml:"for"`        // how long the condition must hold to fire
+	Offline    time.Duration `yaml:"offline"`    // fire when device is silent for this time, instead of field check
+}
+
+// DeviceMatch selects devices by MAC, name and model. Empty values
+// match any device.
+type DeviceMatch struct {
+	MAC   string `yaml:"mac"`
+	Name  string `yaml:"name"`
+	Model string `yaml:"model"`
+}
+
+// WebhookConfig is the configuration of alert notifications sent
+// as HTTP POST requests.
+type WebhookConfig struct {
+	URL      string            `yaml:"url"`
+	Template string            `yaml:"template"` // Go template of JSON body, Alert is passed to it
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// LoggingConfig is the configuration of logs.
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn, error
+	Format string `yaml:"format"` // text or json
+}
+
+// DefaultBatchConfig is the default configuration of batching
+// for sinks that send readings to remote services.
+var DefaultBatchConfig = BatchConfig{
+	BatchSize:     500,
+	QueueSize:     10000,
+	FlushInterval: 10 * time.Second,
+}
+
+// RealtimeBatchConfig is the configuration of batching for local sinks,
+// that write readings as soon as they come.
+var RealtimeBatchConfig = BatchConfig{
+	BatchSize: 100,
+	QueueSize: 1000,
+}
+
+// DefaultConfig returns the configuration with default values.
+func DefaultConfig() Config {
+	return Config{
+		Listeners: ListenersConfig{
+			HTTP: "0.0.0.0:8080",
+			MQTT: "0.0.0.0:1883",
+		},
+		Devices: Devices{},
+		Pipeline: PipelineConfig{
+			Workers:     4,
+			QueueSize:   1000,
+			DedupWindow: time.Hour,
+			Validation:  ValidationLenient,
+		},
+		Clock: ClockConfig{
+			Policy:       ClockPolicyKeep,
+			MaxSkew:      5 * time.Minute,
+			SyncInterval: time.Hour,
+		},
+		Liveness: LivenessConfig{
+			HeartbeatInterval: time.Minute,
+			MissedHeartbeats:  3,
+		},
+		Outputs: OutputsConfig{
+			Sinks:       []string{"prometheus", "history"},
+			MQTT:        RepublishConfig{Topic: "qingping/readings"},
+			File:        FileConfig{Path: "readings.jsonl"},
+			RemoteWrite: RemoteWriteConfig{BatchConfig: DefaultBatchConfig},
+			InfluxDB:    InfluxConfig{BatchConfig: DefaultBatchConfig},
+		},
+		Alerts: AlertsConfig{
+			CheckInterval: 10 * time.Second,
+		},
+		Health: HealthConfig{
+			MaxSinkErrorRate: 0.5,
+		},
+		Metrics: MetricsConfig{
+			Runtime: true,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// ErrInvalidConfig is returned for configuration that can't be parsed
+// or doesn't pass validation.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// LoadConfig reads the configuration file on top of default values,
+// and then applies environment variables. Empty path means no file.
+func LoadConfig(path string) (Config, error) {
+	conf := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path) //nolint:gosec
+		if err != nil {
+			return Config{}, fmt.Errorf("read file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("%w: parse file: %w", ErrInvalidConfig, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&conf).Elem(), EnvPrefix, os.LookupEnv); err != nil {
+		return Config{}, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	return conf, nil
+}
+
+// applyEnv overrides struct fields with values of environment variables.
+// Strings are taken as is, lists of strings are comma-separated, other
+// values are parsed as YAML.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := range v.NumField() {
+		tag, opts, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		name := prefix
+		if opts != "inline" {
+			name += "_" + strings.ToUpper(tag)
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(env)
+		case field.Type() == reflect.TypeFor[[]string]():
+			field.Set(reflect.ValueOf(splitList(env)))
+		default:
+			if err := yaml.Unmarshal([]byte(env), field.Addr().Interface()); err != nil {
+				return fmt.Errorf("parse %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list skipping empty elements.
+func splitList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Validate checks the configuration and returns all found problems.
+func (c Config) Validate() error {
+	var errs configErrors
+
+	errs.check(c.Listeners.HTTP != "", "listeners.http: empty address")
+	errs.check(c.Listeners.MQTT != "", "listeners.mqtt: empty address")
+
+	c.Auth.validate(&errs)
+	c.HTTP.validate(&errs)
+	c.Calibration.validate(&errs)
+
+	errs.check(c.Pipeline.Workers > 0, "pipeline.workers: must be positive")
+	errs.check(c.Pipeline.QueueSize > 0, "pipeline.queue_size: must be positive")
+	errs.check(c.Pipeline.DedupWindow >= 0, "pipeline.dedup_window: must not be negative")
+	errs.check(slices.Contains([]string{ValidationLenient, ValidationStrict}, c.Pipeline.Validation),
+		"pipeline.validation: invalid mode '%s'", c.Pipeline.Validation)
+
+	policies := []string{ClockPolicyKeep, ClockPolicyCorrect, ClockPolicyReject}
+	errs.check(slices.Contains(policies, c.Clock.Policy), "clock.policy: invalid policy '%s'", c.Clock.Policy)
+	errs.check(c.Clock.MaxSkew > 0, "clock.max_skew: must be positive")
+	errs.check(c.Clock.SyncInterval >= 0, "clock.sync_interval: must not be negative")
+
+	errs.check(c.Liveness.HeartbeatInterval > 0, "liveness.heartbeat_interval: must be positive")
+	errs.check(c.Liveness.MissedHeartbeats > 0, "liveness.missed_heartbeats: must be positive")
+
+	c.Outputs.validate(&errs)
+	c.Alerts.validate(&errs)
+
+	errs.check(c.Health.MaxSinkErrorRate >= 0 && c.Health.MaxSinkErrorRate <= 1,
+		"health.max_sink_error_rate: must be between 0 and 1")
+	errs.check(c.Health.MaxMessageAge >= 0, "health.max_message_age: must not be negative")
+
+	_, err := logrus.ParseLevel(c.Logging.Level)
+	errs.check(err == nil, "logging.level: invalid level '%s'", c.Logging.Level)
+	errs.check(slices.Contains([]string{"text", "json"}, c.Logging.Format),
+		"logging.format: invalid format '%s'", c.Logging.Format)
+
+	return errors.Join(errs...)
+}
+
+// configErrors collects validation errors.
+type configErrors []error
+
+// check adds an error if the condition is false.
+func (e *configErrors) check(ok bool, format string, args ...any) {
+	if !ok {
+		*e = append(*e, fmt.Errorf(format, args...))
+	}
+}
+
+func (c AuthConfig) validate(errs *configErrors) {
+	users := map[string]bool{}
+	for i, u := range c.Users {
+		errs.check(u.Username != "", "auth.users[%d].username: empty username", i)
+		errs.check(u.Password != "", "auth.users[%d].password: empty password", i)
+		errs.check(!users[u.Username], "auth.users[%d].username: duplicate user '%s'", i, u.Username)
+		users[u.Username] = true
+	}
+	for i, acl := range c.ACL {
+		errs.check(users[acl.Username], "auth.acl[%d].username: unknown user '%s'", i, acl.Username)
+		for filter, access := range acl.Filters {
+			_, ok := aclAccess[access]
+			errs.check(ok, "auth.acl[%d].filters[%s]: invalid access '%s'", i, filter, access)
+		}
+	}
+}
+
+func (c HTTPConfig) validate(errs *configErrors) {
+	errs.check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""),
+		"http.tls: both cert_file and key_file must be set")
+
+	scopes := []string{ScopeRead, ScopeAdmin}
+	for i, t := range c.Auth.Tokens {
+		errs.check(t.Token != "", "http.auth.tokens[%d].token: empty token", i)
+		errs.check(slices.Contains(scopes, t.Scope), "http.auth.tokens[%d].scope: invalid scope '%s'", i, t.Scope)
+	}
+	users := map[string]bool{}
+	for i, u := range c.Auth.Users {
+		errs.check(u.Username != "", "http.auth.users[%d].username: empty username", i)
+		errs.check(u.Password != "", "http.auth.users[%d].password: empty password", i)
+		errs.check(!users[u.Username], "http.auth.users[%d].username: duplicate user '%s'", i, u.Username)
+		errs.check(slices.Contains(scopes, u.Scope), "http.auth.users[%d].scope: invalid scope '%s'", i, u.Scope)
+		users[u.Username] = true
+	}
+	errs.check(!c.Auth.Metrics || c.Auth.Enabled(), "http.auth.metrics: no tokens or users")
+}
+
+func (c CalibrationConfig) validate(errs *configErrors) {
+	for section, calibrations := range map[string]map[string]Calibration{"models": c.Models, "devices": c.Devices} {
+		for key, calibration := range calibrations {
+			for field, fc := range calibration {
+				prefix := fmt.Sprintf("calibration.%s[%s].%s", section, key, field)
+				errs.check(slices.Contains(qingping.SensorFields, field), "%s: unknown field", prefix)
+				errs.check(fc.Min == nil || fc.Max == nil || *fc.Min <= *fc.Max, "%s: min is greater than max", prefix)
+			}
+		}
+	}
+}
+
+func (c OutputsConfig) validate(errs *configErrors) {
+	for _, name := range c.Sinks {
+		_, ok := SinkRegistry[name]
+		errs.check(ok, "outputs.sinks: unknown sink '%s'", name)
+	}
+	for sink, units := range c.Units {
+		_, ok := SinkRegistry[sink]
+		errs.check(ok, "outputs.units[%s]: unknown sink", sink)
+		for field, list := range units.list() {
+			for _, unit := range list {
+				_, ok := unitConversions[field][unit]
+				errs.check(ok, "outputs.units[%s].%s: invalid unit '%s'", sink, field, unit)
+			}
+		}
+	}
+	if slices.Contains(c.Sinks, "mqtt") {
+		errs.check(c.MQTT.Topic != "", "outputs.mqtt.topic: empty topic")
+	}
+	if slices.Contains(c.Sinks, "file") {
+		errs.check(c.File.Path != "", "outputs.file.path: empty path")
+	}
+	if slices.Contains(c.Sinks, "remote_write") {
+		errs.check(c.RemoteWrite.URL != "", "outputs.remote_write.url: empty URL")
+		c.RemoteWrite.validate(errs, "outputs.remote_write")
+	}
+	if slices.Contains(c.Sinks, "influxdb") {
+		errs.check(c.InfluxDB.URL != "", "outputs.influxdb.url: empty URL")
+		errs.check(c.InfluxDB.Org != "", "outputs.influxdb.org: empty organization")
+		errs.check(c.InfluxDB.Bucket != "", "outputs.influxdb.bucket: empty bucket")
+		c.InfluxDB.validate(errs, "outputs.influxdb")
+	}
+}
+
+func (c AlertsConfig) validate(errs *configErrors) {
+	errs.check(c.CheckInterval > 0, "alerts.check_interval: must be positive")
+
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		errs.check(r.Name != "", "alerts.rules[%d].name: empty name", i)
+		errs.check(!names[r.Name], "alerts.rules[%d].name: duplicate rule '%s'", i, r.Name)
+		names[r.Name] = true
+
+		if r.Offline != 0 {
+			errs.check(r.Offline > 0, "alerts.rules[%d].offline: must be positive", i)
+			errs.check(r.Field == "", "alerts.rules[%d].field: must be empty for offline rule", i)
+			continue
+		}
+		errs.check(slices.Contains(qingping.SensorFields, r.Field), "alerts.rules[%d].field: unknown field '%s'", i, r.Field)
+		_, ok := alertOps[r.Op]
+		errs.check(ok, "alerts.rules[%d].op: invalid operator '%s'", i, r.Op)
+		errs.check(r.Hysteresis >= 0, "alerts.rules[%d].hysteresis: must not be negative", i)
+		errs.check(r.For >= 0, "alerts.rules[%d].for: must not be negative", i)
+	}
+
+	for i, w := range c.Webhooks {
+		errs.check(w.URL != "", "alerts.webhooks[%d].url: empty URL", i)
+		_, err := parseWebhookTemplate("", w.Template)
+		errs.check(err == nil, "alerts.webhooks[%d].template: %v", i, err)
+	}
+}
+
+func (c BatchConfig) validate(errs *configErrors, prefix string) {
+	errs.check(c.BatchSize > 0, "%s.batch_size: must be positive", prefix)
+	errs.check(c.QueueSize > 0, "%s.queue_size: must be positive", prefix)
+	errs.check(c.FlushInterval >= 0, "%s.flush_interval: must not be negative", prefix)
+}
+
+// Redacted returns a copy of the configuration with secrets hidden.
+func (c Config) Redacted() Config {
+	users := make([]UserConfig, len(c.Auth.Users))
+	for i, u := range c.Auth.Users {
+		users[i] = UserConfig{Username: u.Username, Password: redacted}
+	}
+	c.Auth.Users = users
+	tokens := make([]TokenConfig, len(c.HTTP.Auth.Tokens))
+	for i, t := range c.HTTP.Auth.Tokens {
+		tokens[i] = TokenConfig{Token: redacted, Scope: t.Scope}
+	}
+	c.HTTP.Auth.Tokens = tokens
+	httpUsers := make([]HTTPUserConfig, len(c.HTTP.Auth.Users))
+	for i, u := range c.HTTP.Auth.Users {
+		httpUsers[i] = HTTPUserConfig{Username: u.Username, Password: redacted, Scope: u.Scope}
+	}
+	c.HTTP.Auth.Users = httpUsers
+	if c.Outputs.InfluxDB.Token != "" {
+		c.Outputs.InfluxDB.Token = redacted
+	}
+	webhooks := make([]WebhookConfig, len(c.Alerts.Webhooks))
+	for i, w := range c.Alerts.Webhooks {
+		webhooks[i] = w
+		webhooks[i].Headers = make(map[string]string, len(w.Headers))
+		for k := range w.Headers {
+			webhooks[i].Headers[k] = redacted
+		}
+	}
+	c.Alerts.Webhooks = webhooks
+	return c
+}
+
+// Diff returns human-readable changes between the configurations in format
+// "key: old -> new". Changes are found by comparing raw values, so changes
+// of secrets are listed too, but their values are not shown.
+func (c Config) Diff(next Config) []string {
+	before, after := c.flatten(), next.flatten()
+	shownBefore, shownAfter := c.Redacted().flatten(), next.Redacted().flatten()
+	var changes []string
+	for key, v := range after {
+		if old, ok := before[key]; !ok || old != v {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, shownBefore[key], shownAfter[key]))
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: %s -> ", key, shownBefore[key]))
+		}
+	}
+	slices.Sort(changes)
+	return changes
+}
+
+// flatten returns values of the configuration keyed by their path.
+// Lists are kept as single values.
+func (c Config) flatten() map[string]string {
+	data, _ := yaml.Marshal(c)
+	var tree map[string]any
+	yaml.Unmarshal(data, &tree) //nolint:errcheck,gosec
+
+	values := map[string]string{}
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		m, ok := v.(map[string]any)
+		if !ok {
+			values[prefix] = fmt.Sprint(v)
+			return
+		}
+		for k, child := range m {
+			walk(strings.TrimPrefix(prefix+"."+k, "."), child)
+		}
+	}
+	walk("", tree)
+	return values
+}
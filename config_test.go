@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	data := `
+listeners:
+  mqtt: 127.0.0.1:1883
+devices:
+  "AABBCCDDEEFF":
+    name: bedroom
+    model: CGS1
+pipeline:
+  workers: 8
+outputs:
+  sinks: [prometheus, influxdb]
+  influxdb:
+    url: http://localhost:8086
+    org: home
+    bucket: air
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	t.Setenv("QINGPING_LISTENERS_HTTP", "127.0.0.1:9090")
+	t.Setenv("QINGPING_PIPELINE_DEDUP_WINDOW", "10m")
+	t.Setenv("QINGPING_OUTPUTS_SINKS", "prometheus, history,influxdb")
+	t.Setenv("QINGPING_OUTPUTS_INFLUXDB_TOKEN", "secret")
+	t.Setenv("QINGPING_OUTPUTS_INFLUXDB_BATCH_SIZE", "50")
+
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	expected := DefaultConfig()
+	expected.Listeners = ListenersConfig{HTTP: "127.0.0.1:9090", MQTT: "127.0.0.1:1883"}
+	expected.Devices = Devices{"AABBCCDDEEFF": {Name: "bedroom", Model: "CGS1"}}
+	expected.Pipeline.Workers = 8
+	expected.Pipeline.DedupWindow = 10 * time.Minute
+	expected.Outputs.Sinks = []string{"prometheus", "history", "influxdb"}
+	expected.Outputs.InfluxDB = InfluxConfig{
+		URL:         "http://localhost:8086",
+		Org:         "home",
+		Bucket:      "air",
+		Token:       "secret",
+		BatchConfig: DefaultBatchConfig,
+	}
+	expected.Outputs.InfluxDB.BatchSize = 50
+
+	got, _ := yaml.Marshal(conf)
+	want, _ := yaml.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("Unexpected config:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("listeners:\n  htp: :8080\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("Expected error for unknown key")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Pipeline.Workers = 0
+	conf.Pipeline.Validation = "loose"
+	conf.Clock.Policy = "ignore"
+	conf.Auth.Users = []UserConfig{{Username: "device"}}
+	conf.Auth.ACL = []ACLConfig{{Username: "device", Filters: map[string]string{"#": "all"}}}
+	conf.Outputs.Sinks = []string{"prometheus", "remote_write", "kafka"}
+	conf.HTTP.TLS.CertFile = "cert.pem"
+	conf.HTTP.Auth.Tokens = []TokenConfig{{Token: "secret", Scope: "write"}}
+
+	err := conf.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation error")
+	}
+	for _, msg := range []string{
+		"pipeline.workers: must be positive",
+		"pipeline.validation: invalid mode 'loose'",
+		"clock.policy: invalid policy 'ignore'",
+		"auth.users[0].password: empty password",
+		"auth.acl[0].filters[#]: invalid access 'all'",
+		"outputs.sinks: unknown sink 'kafka'",
+		"outputs.remote_write.url: empty URL",
+		"http.tls: both cert_file and key_file must be set",
+		"http.auth.tokens[0].scope: invalid scope 'write'",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error '%s', got:\n%v", msg, err)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Auth.Users = []UserConfig{{Username: "device", Password: "pass"}}
+	conf.Outputs.InfluxDB.Token = "token"
+	conf.HTTP.Auth.Tokens = []TokenConfig{{Token: "secret", Scope: ScopeAdmin}}
+
+	r := conf.Redacted()
+	if r.Auth.Users[0].Password != redacted || r.Outputs.InfluxDB.Token != redacted ||
+		r.HTTP.Auth.Tokens[0].Token != redacted {
+		t.Errorf("Secrets are not redacted: %+v", r)
+	}
+	if conf.Auth.Users[0].Password != "pass" {
+		t.Errorf("Original config is modified")
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Auth.Users = []UserConfig{{Username: "device", Password: "old-password"}}
+	conf.HTTP.Auth.Tokens = []TokenConfig{{Token: "old-token", Scope: ScopeAdmin}}
+
+	// Changes of secrets are found, but their values are not shown
+	next := conf
+	next.Auth.Users = []UserConfig{{Username: "device", Password: "new-password"}}
+	next.HTTP.Auth.Tokens = []TokenConfig{{Token: "new-token", Scope: ScopeAdmin}}
+	changes := conf.Diff(next)
+	if len(changes) != 2 ||
+		!strings.HasPrefix(changes[0], "auth.users: ") || !strings.HasPrefix(changes[1], "http.auth.tokens: ") {
+		t.Fatalf("Unexpected changes: %v", changes)
+	}
+	for _, change := range changes {
+		if strings.Contains(change, "old-") || strings.Contains(change, "new-") {
+			t.Errorf("Secret is not redacted: %s", change)
+		}
+	}
+
+	if changes := conf.Diff(conf); len(changes) != 0 {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+// Dedup detects messages and samples that devices send again when they
+// don't receive an acknowledgment in time. Messages are identified by
+// device MAC and message ID, samples by device MAC and timestamp.
+// Keys are remembered for the duration of the window.
+type Dedup struct {
+	window   time.Duration
+	messages map[dedupKey]time.Time
+	samples  map[dedupKey]time.Time
+	cleaned  time.Time
+	metrics  *Metrics
+	mx       sync.Mutex
+}
+
+type dedupKey struct {
+	mac string
+	id  int64
+}
+
+// NewDedup creates a new deduplicator. Zero window disables deduplication.
+func NewDedup(window time.Duration, metrics *Metrics) *Dedup {
+	return &Dedup{
+		window:   window,
+		messages: make(map[dedupKey]time.Time),
+		samples:  make(map[dedupKey]time.Time),
+		cleaned:  time.Now(),
+		metrics:  metrics,
+	}
+}
+
+// Message reports whether the message has already been seen.
+// Messages without ID are never duplicates.
+func (d *Dedup) Message(mac string, id int) bool {
+	if id == 0 {
+		return false
+	}
+	return d.seen(d.messages, dedupKey{mac: mac, id: int64(id)})
+}
+
+// SensorData returns samples of the device that haven't been seen yet.
+// Samples without timestamp are never duplicates.
+func (d *Dedup) SensorData(mac string, data []qingping.SensorData) []qingping.SensorData {
+	fresh := make([]qingping.SensorData, 0, len(data))
+	for _, s := range data {
+		key := dedupKey{mac: mac, id: int64(s.Timestamp.Value)}
+		if s.Timestamp.Value > 0 && d.seen(d.samples, key) {
+			d.metrics.DuplicatesCounter.WithLabelValues("sample").Inc()
+			continue
+		}
+		fresh = append(fresh, s)
+	}
+	return fresh
+}
+
+// seen checks the key and remembers it.
+func (d *Dedup) seen(keys map[dedupKey]time.Time, key dedupKey) bool {
+	if d.window == 0 {
+		return false
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	now := time.Now()
+	d.cleanup(now)
+
+	if t, ok := keys[key]; ok && now.Sub(t) < d.window {
+		return true
+	}
+	keys[key] = now
+	return false
+}
+
+// cleanup removes expired keys. It runs not more often than
+// every tenth of the window.
+func (d *Dedup) cleanup(now time.Time) {
+	if now.Sub(d.cleaned) < d.window/10 {
+		return
+	}
+	for _, keys := range []map[dedupKey]time.Time{d.messages, d.samples} {
+		for k, t := range keys {
+			if now.Sub(t) >= d.window {
+				delete(keys, k)
+			}
+		}
+	}
+	d.cleaned = now
+}
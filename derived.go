@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+)
+
+// Names of metrics derived from sensor values.
+const (
+	DerivedAQIUS            = "aqi_us"
+	DerivedAQIEU            = "aqi_eu"
+	DerivedDewPoint         = "dew_point"
+	DerivedAbsoluteHumidity = "absolute_humidity"
+	DerivedHeatIndex        = "heat_index"
+	DerivedCO2Category      = "co2_category"
+)
+
+// aqiBreakpoint maps a concentration range to an index range.
+type aqiBreakpoint struct {
+	cLow, cHigh float64
+	iLow, iHigh float64
+}
+
+// US EPA AQI breakpoints (2024 revision), concentrations in µg/m³.
+var (
+	usAQIPM25 = []aqiBreakpoint{
+		{0, 9.0, 0, 50},
+		{9.1, 35.4, 51, 100},
+		{35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200},
+		{125.5, 225.4, 201, 300},
+		{225.5, 325.4, 301, 500},
+	}
+	usAQIPM10 = []aqiBreakpoint{
+		{0, 54, 0, 50},
+		{55, 154, 51, 100},
+		{155, 254, 101, 150},
+		{255, 354, 151, 200},
+		{355, 424, 201, 300},
+		{425, 604, 301, 500},
+	}
+)
+
+// Upper bounds of European AQI levels 1 (good) to 5 (very poor),
+// concentrations in µg/m³. Values above the last bound give level 6
+// (extremely poor).
+var (
+	euAQIPM25 = []float64{5, 15, 50, 90, 140}
+	euAQIPM10 = []float64{15, 45, 120, 195, 270}
+)
+
+// Upper bounds of CO2 categories IDA 1 (high quality) to 3 (moderate
+// quality) from EN 13779, in ppm, assuming 400 ppm outdoors. Values above
+// the last bound give IDA 4 (low quality).
+var co2Categories = []float64{750, 900, 1200}
+
+// Derive computes air quality and comfort metrics from sensor values.
+// Metrics are computed only when all their inputs are present.
+func Derive(fields map[string]float64) map[string]float64 {
+	derived := map[string]float64{}
+
+	pm25, hasPM25 := fields["pm25"]
+	pm10, hasPM10 := fields["pm10"]
+	if hasPM25 || hasPM10 {
+		var us, eu float64
+		if hasPM25 {
+			us = max(us, USAQI(math.Floor(pm25*10)/10, usAQIPM25))
+			eu = max(eu, EUAQI(pm25, euAQIPM25))
+		}
+		if hasPM10 {
+			us = max(us, USAQI(math.Floor(pm10), usAQIPM10))
+			eu = max(eu, EUAQI(pm10, euAQIPM10))
+		}
+		derived[DerivedAQIUS] = us
+		derived[DerivedAQIEU] = eu
+	}
+
+	t, hasT := fields["temperature"]
+	rh, hasRH := fields["humidity"]
+	if hasT && hasRH && rh > 0 {
+		derived[DerivedDewPoint] = DewPoint(t, rh)
+		derived[DerivedAbsoluteHumidity] = AbsoluteHumidity(t, rh)
+		derived[DerivedHeatIndex] = HeatIndex(t, rh)
+	}
+
+	if co2, ok := fields["co2"]; ok {
+		derived[DerivedCO2Category] = level(co2, co2Categories)
+	}
+
+	return derived
+}
+
+// USAQI returns US EPA Air Quality Index of the pollutant concentration.
+// The concentration must be truncated to the precision of breakpoints.
+// Values above the scale give 500.
+func USAQI(c float64, breakpoints []aqiBreakpoint) float64 {
+	for _, bp := range breakpoints {
+		// Truncated concentrations fall between ranges only by rounding errors
+		if c <= bp.cHigh {
+			c = max(c, bp.cLow)
+			return math.Round((bp.iHigh-bp.iLow)/(bp.cHigh-bp.cLow)*(c-bp.cLow) + bp.iLow)
+		}
+	}
+	return breakpoints[len(breakpoints)-1].iHigh
+}
+
+// EUAQI returns European Air Quality Index level from 1 (good)
+// to 6 (extremely poor) of the pollutant concentration.
+func EUAQI(c float64, bounds []float64) float64 {
+	return level(c, bounds)
+}
+
+// level returns 1-based number of the first range with upper bound
+// not less than the value.
+func level(v float64, bounds []float64) float64 {
+	for i, b := range bounds {
+		if v <= b {
+			return float64(i + 1)
+		}
+	}
+	return float64(len(bounds) + 1)
+}
+
+// DewPoint returns dew point in Celsius using Magnus formula.
+// Humidity must be positive.
+func DewPoint(t, rh float64) float64 {
+	const a, b = 17.62, 243.12
+	g := math.Log(rh/100) + a*t/(b+t)
+	return b * g / (a - g)
+}
+
+// AbsoluteHumidity returns mass of water vapour in g/m³.
+func AbsoluteHumidity(t, rh float64) float64 {
+	// Saturation vapour pressure in hPa
+	ps := 6.112 * math.Exp(17.67*t/(t+243.5))
+	return ps * rh * 2.1674 / (273.15 + t)
+}
+
+// HeatIndex returns apparent temperature in Celsius using the algorithm
+// of US National Weather Service.
+func HeatIndex(t, rh float64) float64 {
+	f := t*9/5 + 32
+
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 >= 80 {
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh -
+			0.22475541*f*rh - 0.00683783*f*f - 0.05481717*rh*rh +
+			0.00122874*f*f*rh + 0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+		if rh < 13 && f >= 80 && f <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		}
+		if rh > 85 && f >= 80 && f <= 87 {
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fields   map[string]float64
+		expected map[string]float64
+	}{
+		{
+			name:   "particulates",
+			fields: map[string]float64{"pm25": 12.05, "pm10": 100},
+			expected: map[string]float64{
+				DerivedAQIUS: 73, // pm10 gives 73, pm2.5 gives 56
+				DerivedAQIEU: 3,
+			},
+		},
+		{
+			name:     "pm2.5 only",
+			fields:   map[string]float64{"pm25": 35.49},
+			expected: map[string]float64{DerivedAQIUS: 100, DerivedAQIEU: 3},
+		},
+		{
+			name:     "off scale",
+			fields:   map[string]float64{"pm25": 1000},
+			expected: map[string]float64{DerivedAQIUS: 500, DerivedAQIEU: 6},
+		},
+		{
+			name:     "clean air",
+			fields:   map[string]float64{"pm25": 0, "pm10": 3},
+			expected: map[string]float64{DerivedAQIUS: 3, DerivedAQIEU: 1},
+		},
+		{
+			name:   "temperature and humidity",
+			fields: map[string]float64{"temperature": 20, "humidity": 50},
+			expected: map[string]float64{
+				DerivedDewPoint:         9.26,
+				DerivedAbsoluteHumidity: 8.63,
+				DerivedHeatIndex:        19.4,
+			},
+		},
+		{
+			name:   "hot and humid",
+			fields: map[string]float64{"temperature": 32.2, "humidity": 70},
+			expected: map[string]float64{
+				DerivedDewPoint:         26.1,
+				DerivedAbsoluteHumidity: 23.9,
+				DerivedHeatIndex:        41.1, // 106 °F in NWS table for 90 °F and 70%
+			},
+		},
+		{
+			name:     "temperature without humidity",
+			fields:   map[string]float64{"temperature": 20},
+			expected: map[string]float64{},
+		},
+		{
+			name:     "good ventilation",
+			fields:   map[string]float64{"co2": 600},
+			expected: map[string]float64{DerivedCO2Category: 1},
+		},
+		{
+			name:     "poor ventilation",
+			fields:   map[string]float64{"co2": 1100},
+			expected: map[string]float64{DerivedCO2Category: 3},
+		},
+		{
+			name:     "bad ventilation",
+			fields:   map[string]float64{"co2": 2000},
+			expected: map[string]float64{DerivedCO2Category: 4},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			derived := Derive(tc.fields)
+			if len(derived) != len(tc.expected) {
+				t.Fatalf("Expected %v, got %v", tc.expected, derived)
+			}
+			for name, exp := range tc.expected {
+				if got, ok := derived[name]; !ok || math.Abs(got-exp) > 0.1 {
+					t.Errorf("Expected %s=%v, got %v", name, exp, got)
+				}
+			}
+		})
+	}
+}
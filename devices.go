@@ -0,0 +1,16 @@
+package main
+
+// Device describes a known device.
+type Device struct {
+	Name  string `json:"name,omitempty"  yaml:"name"`
+	Model string `json:"model,omitempty" yaml:"model"`
+}
+
+// Devices maps MAC addresses of known devices to their descriptions.
+type Devices map[string]Device
+
+// Get returns description of the device. Unknown devices get
+// an empty description.
+func (d Devices) Get(mac string) Device {
+	return d[mac]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Types of events.
+const (
+	EventReading    = "reading"
+	EventOnline     = "online"
+	EventOffline    = "offline"
+	EventParseError = "parse_error"
+	EventAck        = "ack"
+)
+
+// EventTypes is the list of all event types.
+var EventTypes = []string{
+	EventReading, EventOnline, EventOffline, EventParseError, EventAck,
+}
+
+// eventQueueSize is the number of events buffered for each subscriber.
+// Events are dropped for subscribers that don't keep up.
+const eventQueueSize = 100
+
+// Event is something that happened with a device.
+type Event struct {
+	Type string    `json:"type"`
+	MAC  string    `json:"mac,omitempty"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// ParseErrorEvent is the data of parse_error event.
+type ParseErrorEvent struct {
+	Topic string `json:"topic"`
+	Error string `json:"error"`
+}
+
+// AckEvent is the data of ack event.
+type AckEvent struct {
+	Topic string `json:"topic"`
+	MsgID int    `json:"msg_id"`
+}
+
+// EventFilter selects events by MAC and type. Empty lists match everything.
+type EventFilter struct {
+	MACs  []string
+	Types []string
+}
+
+// Matches checks if the event passes the filter.
+func (f EventFilter) Matches(e Event) bool {
+	if len(f.MACs) > 0 && !slices.Contains(f.MACs, e.MAC) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	return true
+}
+
+// Events delivers events to subscribers.
+type Events struct {
+	subs    map[chan Event]EventFilter
+	metrics *Metrics
+	mx      sync.RWMutex
+}
+
+// NewEvents creates a new event bus.
+func NewEvents(metrics *Metrics) *Events {
+	return &Events{subs: make(map[chan Event]EventFilter), metrics: metrics}
+}
+
+// Publish sends the event to all matching subscribers without blocking.
+func (e *Events) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	for ch, filter := range e.subs {
+		if !filter.Matches(event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			e.metrics.EventsDroppedCounter.Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel of events matching the filter, and
+// a function to unsubscribe.
+func (e *Events) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	ch := make(chan Event, eventQueueSize)
+
+	e.mx.Lock()
+	e.subs[ch] = filter
+	e.mx.Unlock()
+	e.metrics.EventSubscribersGauge.Inc()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mx.Lock()
+			delete(e.subs, ch)
+			e.mx.Unlock()
+			e.metrics.EventSubscribersGauge.Dec()
+		})
+	}
+}
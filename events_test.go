@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	events := NewEvents(NewMetrics(MetricsConfig{}))
+	all, unsubscribeAll := events.Subscribe(EventFilter{})
+	defer unsubscribeAll()
+	filtered, unsubscribe := events.Subscribe(EventFilter{
+		MACs:  []string{"MAC1"},
+		Types: []string{EventOnline, EventOffline},
+	})
+
+	events.Publish(Event{Type: EventOnline, MAC: "MAC1"})
+	events.Publish(Event{Type: EventOnline, MAC: "MAC2"})
+	events.Publish(Event{Type: EventReading, MAC: "MAC1"})
+
+	if n := len(all); n != 3 {
+		t.Fatalf("Expected 3 events without filter, got %d", n)
+	}
+	if n := len(filtered); n != 1 {
+		t.Fatalf("Expected 1 filtered event, got %d", n)
+	}
+	e := <-filtered
+	if e.Type != EventOnline || e.MAC != "MAC1" || e.Time.IsZero() {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+
+	unsubscribe()
+	unsubscribe() // safe to call twice
+	events.Publish(Event{Type: EventOffline, MAC: "MAC1"})
+	if n := len(filtered); n != 0 {
+		t.Fatalf("Expected no events after unsubscribe, got %d", n)
+	}
+
+	// Events for slow subscribers are dropped instead of blocking
+	for range eventQueueSize {
+		events.Publish(Event{Type: EventReading, MAC: "MAC1"})
+	}
+	if n := len(all); n != eventQueueSize {
+		t.Fatalf("Expected full queue of %d events, got %d", eventQueueSize, n)
+	}
+}
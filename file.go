@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileSink is a sink that appends readings to a file as JSON lines.
+type FileSink struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileSink opens the file for appending, creating it if necessary.
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty file path")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	return &FileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends readings to the file.
+func (s *FileSink) Write(readings []Reading) error {
+	for _, r := range readings {
+		if err := s.enc.Encode(r); err != nil {
+			return fmt.Errorf("write reading: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.file.Close() //nolint:wrapcheck
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Statuses of health checks.
+const (
+	HealthOK     = "ok"
+	HealthFailed = "failed"
+)
+
+// HealthResponse is the response of health and readiness endpoints.
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of a component check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Details any    `json:"details,omitempty"`
+
+	// Critical checks fail liveness, others fail only readiness
+	critical bool
+}
+
+// CheckHealth checks components of the service. For liveness only
+// critical checks are taken into account, for readiness all of them.
+func CheckHealth(
+	broker BrokerStatus,
+	sinks []SinkStatus,
+	conf HealthConfig,
+	ready bool,
+	now time.Time,
+) HealthResponse {
+	checks := []HealthCheck{checkBroker(broker)}
+	for _, s := range sinks {
+		checks = append(checks, checkSink(s, conf))
+	}
+	if conf.MaxMessageAge > 0 {
+		checks = append(checks, checkMessages(broker, conf, now))
+	}
+
+	resp := HealthResponse{Status: HealthOK, Checks: checks}
+	for _, c := range checks {
+		if c.Status == HealthFailed && (ready || c.critical) {
+			resp.Status = HealthFailed
+		}
+	}
+	return resp
+}
+
+func checkBroker(status BrokerStatus) HealthCheck {
+	check := HealthCheck{Name: "mqtt", Status: HealthOK, Details: status, critical: true}
+	switch {
+	case !status.Serving:
+		check.Status = HealthFailed
+		check.Error = "broker is not serving"
+	case len(status.Listeners) == 0:
+		check.Status = HealthFailed
+		check.Error = "no listeners accepting connections"
+	}
+	return check
+}
+
+func checkSink(status SinkStatus, conf HealthConfig) HealthCheck {
+	check := HealthCheck{Name: "sink:" + status.Name, Status: HealthOK, Details: status}
+	if status.Batches > 0 && status.ErrorRate > conf.MaxSinkErrorRate {
+		check.Status = HealthFailed
+		check.Error = fmt.Sprintf("error rate %.2f is above %.2f", status.ErrorRate, conf.MaxSinkErrorRate)
+	}
+	return check
+}
+
+// checkMessages checks the time of the last message, or the start time
+// if there were no messages yet.
+func checkMessages(status BrokerStatus, conf HealthConfig, now time.Time) HealthCheck {
+	last := status.LastMessage
+	if last.IsZero() {
+		last = status.Started
+	}
+	check := HealthCheck{Name: "messages", Status: HealthOK}
+	if age := now.Sub(last); !last.IsZero() && age > conf.MaxMessageAge {
+		check.Status = HealthFailed
+		check.Error = fmt.Sprintf("no messages for %s", age.Round(time.Second))
+	}
+	return check
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	now := time.Now()
+	broker := BrokerStatus{
+		Serving:     true,
+		Listeners:   map[string]string{"tcp": "127.0.0.1:1883"},
+		Started:     now.Add(-time.Hour),
+		LastMessage: now.Add(-time.Minute),
+	}
+	conf := HealthConfig{MaxSinkErrorRate: 0.5}
+
+	testCases := []struct {
+		name   string
+		broker func(BrokerStatus) BrokerStatus
+		sinks  []SinkStatus
+		conf   func(HealthConfig) HealthConfig
+		live   string
+		ready  string
+	}{
+		{
+			name:  "healthy",
+			sinks: []SinkStatus{{Name: "prometheus", Batches: 10, ErrorRate: 0.1}},
+			live:  HealthOK,
+			ready: HealthOK,
+		},
+		{
+			name: "broker is not serving",
+			broker: func(s BrokerStatus) BrokerStatus {
+				s.Serving = false
+				return s
+			},
+			live:  HealthFailed,
+			ready: HealthFailed,
+		},
+		{
+			name: "listener is not accepting connections",
+			broker: func(s BrokerStatus) BrokerStatus {
+				s.Listeners = map[string]string{}
+				return s
+			},
+			live:  HealthFailed,
+			ready: HealthFailed,
+		},
+		{
+			name:  "failing sink",
+			sinks: []SinkStatus{{Name: "influxdb", Batches: 10, ErrorRate: 0.6}},
+			live:  HealthOK,
+			ready: HealthFailed,
+		},
+		{
+			name: "no recent messages",
+			conf: func(c HealthConfig) HealthConfig {
+				c.MaxMessageAge = 30 * time.Second
+				return c
+			},
+			live:  HealthOK,
+			ready: HealthFailed,
+		},
+		{
+			name: "no messages since recent start",
+			broker: func(s BrokerStatus) BrokerStatus {
+				s.Started = now.Add(-10 * time.Second)
+				s.LastMessage = time.Time{}
+				return s
+			},
+			conf: func(c HealthConfig) HealthConfig {
+				c.MaxMessageAge = 30 * time.Second
+				return c
+			},
+			live:  HealthOK,
+			ready: HealthOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, c := broker, conf
+			if tc.broker != nil {
+				b = tc.broker(b)
+			}
+			if tc.conf != nil {
+				c = tc.conf(c)
+			}
+			if s := CheckHealth(b, tc.sinks, c, false, now).Status; s != tc.live {
+				t.Errorf("Expected liveness %s, got %s", tc.live, s)
+			}
+			if s := CheckHealth(b, tc.sinks, c, true, now).Status; s != tc.ready {
+				t.Errorf("Expected readiness %s, got %s", tc.ready, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// HistorySize is the maximum number of samples kept per device.
+// With the default device upload interval of 1 minute this is one week.
+const HistorySize = 7 * 24 * 60
+
+// Aggregation functions for downsampling.
+const (
+	AggAvg = "avg"
+	AggMin = "min"
+	AggMax = "max"
+)
+
+// History keeps recent sensor samples of all devices in memory.
+type History struct {
+	samples map[string][]Sample
+	size    int
+	mx      sync.RWMutex
+}
+
+// Sample is a set of sensor values measured at the same time.
+type Sample struct {
+	Time   time.Time
+	Fields map[string]float64
+}
+
+// HistorySink is a sink that saves readings to the history.
+type HistorySink struct {
+	History *History
+}
+
+// Write saves readings to the history.
+func (s HistorySink) Write(readings []Reading) error {
+	for _, r := range readings {
+		s.History.Add(r.MAC, Sample{Time: r.Time, Fields: r.Fields})
+	}
+	return nil
+}
+
+// Point is a single value of a sensor.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// NewHistory creates a new history storage that keeps up to size samples
+// per device.
+func NewHistory(size int) *History {
+	return &History{
+		samples: make(map[string][]Sample),
+		size:    size,
+	}
+}
+
+// Add saves samples of the device. Samples are kept sorted by time,
+// the oldest ones are dropped when the limit is reached.
+func (h *History) Add(mac string, samples ...Sample) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	list := h.samples[mac]
+	for _, s := range samples {
+		i, found := slices.BinarySearchFunc(list, s.Time, func(s Sample, t time.Time) int {
+			return s.Time.Compare(t)
+		})
+		if found {
+			list[i] = s
+			continue
+		}
+		list = slices.Insert(list, i, s)
+	}
+	if len(list) > h.size {
+		list = slices.Delete(list, 0, len(list)-h.size)
+	}
+	h.samples[mac] = list
+}
+
+// Query returns values of the field for the device within the [from, to]
+// time range. Zero from or to means no limit. The second value reports
+// whether the device is known.
+func (h *History) Query(mac, field string, from, to time.Time) ([]Point, bool) {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	list, ok := h.samples[mac]
+	if !ok {
+		return nil, false
+	}
+
+	points := []Point{}
+	for _, s := range list {
+		if !from.IsZero() && s.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && s.Time.After(to) {
+			break
+		}
+		if v, ok := s.Fields[field]; ok {
+			points = append(points, Point{Time: s.Time, Value: v})
+		}
+	}
+	return points, true
+}
+
+// Downsample groups sorted points into buckets of the given step and
+// aggregates each bucket into a single point using the aggregation function.
+// Bucket points are stamped with the start time of the bucket.
+func Downsample(points []Point, step time.Duration, agg string) []Point {
+	if step <= 0 {
+		return points
+	}
+
+	result := []Point{}
+	var bucket []float64
+	var start time.Time
+	for _, p := range points {
+		t := p.Time.Truncate(step)
+		if len(bucket) > 0 && !t.Equal(start) {
+			result = append(result, Point{Time: start, Value: aggregate(bucket, agg)})
+			bucket = bucket[:0]
+		}
+		start = t
+		bucket = append(bucket, p.Value)
+	}
+	if len(bucket) > 0 {
+		result = append(result, Point{Time: start, Value: aggregate(bucket, agg)})
+	}
+	return result
+}
+
+func aggregate(values []float64, agg string) float64 {
+	switch agg {
+	case AggMin:
+		return slices.Min(values)
+	case AggMax:
+		return slices.Max(values)
+	default:
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	points := []Point{
+		{Time: at(0), Value: 10},
+		{Time: at(4 * time.Minute), Value: 20},
+		{Time: at(5 * time.Minute), Value: 30}, // boundary starts a new bucket
+		{Time: at(9*time.Minute + 59*time.Second), Value: 50},
+		{Time: at(20 * time.Minute), Value: 5}, // empty buckets are skipped
+	}
+
+	testCases := []struct {
+		name     string
+		points   []Point
+		step     time.Duration
+		agg      string
+		expected []Point
+	}{
+		{
+			name:   "avg",
+			points: points,
+			step:   5 * time.Minute,
+			agg:    AggAvg,
+			expected: []Point{
+				{Time: at(0), Value: 15},
+				{Time: at(5 * time.Minute), Value: 40},
+				{Time: at(20 * time.Minute), Value: 5},
+			},
+		},
+		{
+			name:   "min",
+			points: points,
+			step:   5 * time.Minute,
+			agg:    AggMin,
+			expected: []Point{
+				{Time: at(0), Value: 10},
+				{Time: at(5 * time.Minute), Value: 30},
+				{Time: at(20 * time.Minute), Value: 5},
+			},
+		},
+		{
+			name:   "max",
+			points: points,
+			step:   5 * time.Minute,
+			agg:    AggMax,
+			expected: []Point{
+				{Time: at(0), Value: 20},
+				{Time: at(5 * time.Minute), Value: 50},
+				{Time: at(20 * time.Minute), Value: 5},
+			},
+		},
+		{
+			name:   "single bucket",
+			points: points,
+			step:   time.Hour,
+			agg:    AggMax,
+			expected: []Point{
+				{Time: at(0), Value: 50},
+			},
+		},
+		{
+			name:   "bucket starts before the first point",
+			points: []Point{{Time: at(7 * time.Minute), Value: 1}, {Time: at(12 * time.Minute), Value: 3}},
+			step:   10 * time.Minute,
+			agg:    AggAvg,
+			expected: []Point{
+				{Time: at(0), Value: 1},
+				{Time: at(10 * time.Minute), Value: 3},
+			},
+		},
+		{
+			name:     "zero step",
+			points:   points,
+			step:     0,
+			agg:      AggAvg,
+			expected: points,
+		},
+		{
+			name:     "empty input",
+			points:   []Point{},
+			step:     5 * time.Minute,
+			agg:      AggAvg,
+			expected: []Point{},
+		},
+		{
+			name:     "nil input",
+			points:   nil,
+			step:     5 * time.Minute,
+			agg:      AggAvg,
+			expected: []Point{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := Downsample(tc.points, tc.step, tc.agg)
+			if result == nil || !slices.Equal(result, tc.expected) {
+				t.Fatalf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
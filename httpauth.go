@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Scopes of HTTP API credentials. Read scope gives access to GET
+// requests, admin scope gives access to everything.
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// Enabled checks if any credentials are configured.
+func (c HTTPAuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || len(c.Users) > 0
+}
+
+// HTTPAuth checks credentials of HTTP API requests. Configuration can be
+// replaced while the server is running.
+type HTTPAuth struct {
+	conf atomic.Pointer[HTTPAuthConfig]
+}
+
+// NewHTTPAuth creates a new HTTP authenticator.
+func NewHTTPAuth(conf HTTPAuthConfig) *HTTPAuth {
+	a := &HTTPAuth{}
+	a.Set(conf)
+	return a
+}
+
+// Set replaces credentials. They apply to the next request.
+func (a *HTTPAuth) Set(conf HTTPAuthConfig) {
+	a.conf.Store(&conf)
+}
+
+// Middleware checks credentials of requests to /api/* and, if enabled,
+// /metrics. Health checks and the dashboard are always open, the
+// dashboard gets credentials from the browser when calling the API.
+func (a *HTTPAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := a.conf.Load()
+		required := requiredScope(r, conf.Metrics)
+		if required == "" || !conf.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope, ok := conf.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="qingping-mqtt"`)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		if required == ScopeAdmin && scope != ScopeAdmin {
+			writeError(w, http.StatusForbidden, errors.New("admin scope required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requiredScope returns the scope required for the request, or empty
+// string if the request is open.
+func requiredScope(r *http.Request, metrics bool) string {
+	switch {
+	case r.URL.Path == "/metrics" && metrics:
+		return ScopeRead
+	case !strings.HasPrefix(r.URL.Path, "/api/"):
+		return ""
+	case strings.HasPrefix(r.URL.Path, "/api/admin/"):
+		return ScopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ScopeRead
+	default:
+		return ScopeAdmin
+	}
+}
+
+// authenticate returns the scope of the request credentials: a bearer
+// token or basic auth.
+func (c HTTPAuthConfig) authenticate(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range c.Tokens {
+			if secureEqual(token, t.Token) {
+				return t.Scope, true
+			}
+		}
+		return "", false
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, u := range c.Users {
+			if secureEqual(username, u.Username) && secureEqual(password, u.Password) {
+				return u.Scope, true
+			}
+		}
+	}
+	return "", false
+}
+
+// secureEqual compares strings in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
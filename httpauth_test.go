@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuthMiddleware(t *testing.T) {
+	auth := NewHTTPAuth(HTTPAuthConfig{
+		Tokens: []TokenConfig{
+			{Token: "reader", Scope: ScopeRead},
+			{Token: "admin", Scope: ScopeAdmin},
+		},
+		Users: []HTTPUserConfig{{Username: "user", Password: "pass", Scope: ScopeRead}},
+	})
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		user     string
+		expected int
+	}{
+		{name: "health is open", method: "GET", path: "/health", expected: 200},
+		{name: "dashboard is open", method: "GET", path: "/", expected: 200},
+		{name: "metrics are open by default", method: "GET", path: "/metrics", expected: 200},
+		{name: "api without credentials", method: "GET", path: "/api/devices", expected: 401},
+		{name: "api with wrong token", method: "GET", path: "/api/devices", token: "wrong", expected: 401},
+		{name: "read with read token", method: "GET", path: "/api/devices", token: "reader", expected: 200},
+		{name: "read with basic auth", method: "GET", path: "/api/devices", user: "user", expected: 200},
+		{name: "admin with read token", method: "POST", path: "/api/admin/reload", token: "reader", expected: 403},
+		{name: "admin with admin token", method: "POST", path: "/api/admin/reload", token: "admin", expected: 200},
+		{name: "write with read token", method: "DELETE", path: "/api/clients/1", token: "reader", expected: 403},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, "pass")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.expected {
+				t.Errorf("Expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+
+	// Metrics require credentials when enabled
+	auth.Set(HTTPAuthConfig{Tokens: []TokenConfig{{Token: "reader", Scope: ScopeRead}}, Metrics: true})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for metrics, got %d", rec.Code)
+	}
+}
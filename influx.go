@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxTimeout is the timeout of a single InfluxDB write request.
+const influxTimeout = 10 * time.Second
+
+// influxMeasurement is the name of the measurement for all samples.
+const influxMeasurement = "qingping"
+
+// influxEscaper escapes special characters in tag keys and values,
+// and in field keys.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// InfluxWriter is a sink that writes readings to InfluxDB using v2 HTTP API.
+type InfluxWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewInfluxWriter creates a new InfluxDB client.
+func NewInfluxWriter(conf InfluxConfig) *InfluxWriter {
+	query := url.Values{}
+	query.Set("org", conf.Org)
+	query.Set("bucket", conf.Bucket)
+	query.Set("precision", "s")
+
+	return &InfluxWriter{
+		url:    strings.TrimSuffix(conf.URL, "/") + "/api/v2/write?" + query.Encode(),
+		token:  conf.Token,
+		client: &http.Client{Timeout: influxTimeout},
+	}
+}
+
+// Write sends readings to InfluxDB.
+func (w *InfluxWriter) Write(readings []Reading) error {
+	var buf bytes.Buffer
+	for _, r := range readings {
+		buf.WriteString(encodeLine(r))
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), influxTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: send request: %w", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status %d: %s", errRetryable, resp.StatusCode, body)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// encodeLine encodes the reading in InfluxDB line protocol:
+//
+//	qingping,mac=112233445566,model=CGDN1,name=office co2=850,temperature=23.5 1592192453
+//
+// Empty tags are omitted. Readings without fields give an empty string.
+func encodeLine(r Reading) string {
+	if len(r.Fields) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(influxMeasurement)
+	tags := [][2]string{{"mac", r.MAC}, {"model", r.Device.Model}, {"name", r.Device.Name}}
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		b.WriteString("," + tag[0] + "=" + influxEscaper.Replace(tag[1]))
+	}
+
+	for i, f := range slices.Sorted(maps.Keys(r.Fields)) {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscaper.Replace(f) + "=")
+		b.WriteString(strconv.FormatFloat(r.Fields[f], 'f', -1, 64))
+	}
+
+	b.WriteString(" " + strconv.FormatInt(r.Time.Unix(), 10) + "\n")
+	return b.String()
+}
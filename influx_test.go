@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxWriter(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if q := r.URL.Query(); q.Get("org") != "home" || q.Get("bucket") != "air" {
+			t.Errorf("Unexpected query: %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Unexpected authorization: %s", r.Header.Get("Authorization"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := NewInfluxWriter(InfluxConfig{
+		URL:    srv.URL,
+		Org:    "home",
+		Bucket: "air",
+		Token:  "secret",
+	})
+	err := w.Write([]Reading{
+		{
+			MAC:    "112233445566",
+			Time:   time.Unix(1592192453, 0),
+			Fields: map[string]float64{"co2": 850, "temperature": 23.5},
+			Device: Device{Name: "living room", Model: "CGDN1"},
+		},
+		{
+			MAC:    "AABBCCDDEEFF",
+			Time:   time.Unix(1592192460, 0),
+			Fields: map[string]float64{"humidity": 45.2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write readings: %v", err)
+	}
+
+	expected := "qingping,mac=112233445566,model=CGDN1,name=living\\ room co2=850,temperature=23.5 1592192453\n" +
+		"qingping,mac=AABBCCDDEEFF humidity=45.2 1592192460\n"
+	if body != expected {
+		t.Fatalf("Unexpected body:\n%s", body)
+	}
+}
@@ -5,19 +5,63 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
-	debug := flag.Bool("debug", false, "enable debug logs")
-	httpAddr := flag.String("http-addr", "0.0.0.0:8080", "HTTP server listen address")
-	mqttAddr := flag.String("mqtt-addr", "0.0.0.0:1883", "MQTT broker listen address")
+	configPath := flag.String("config", "", "path to the YAML configuration file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	debug := flag.Bool("debug", false, "enable debug logs (overrides logging.level)")
+	httpAddr := flag.String("http-addr", "", "HTTP server listen address (overrides listeners.http)")
+	mqttAddr := flag.String("mqtt-addr", "", "MQTT broker listen address (overrides listeners.mqtt)")
 	flag.Parse()
 
+	log := logrus.New()
+	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+
+	// Flags take precedence over the file and environment
+	load := func() (Config, error) {
+		conf, err := LoadConfig(*configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		if *debug {
+			conf.Logging.Level = logrus.DebugLevel.String()
+		}
+		if *httpAddr != "" {
+			conf.Listeners.HTTP = *httpAddr
+		}
+		if *mqttAddr != "" {
+			conf.Listeners.MQTT = *mqttAddr
+		}
+		return conf, nil
+	}
+
+	conf, err := load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+
+	if *printConfig {
+		data, err := yaml.Marshal(conf.Redacted())
+		if err != nil {
+			log.Fatalf("Failed to print config: %v", err)
+		}
+		fmt.Print(string(data))
+		return
+	}
+
+	setLogging(log, conf.Logging)
+
 	ctx, cancel := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt,
@@ -25,20 +69,23 @@ func main() {
 	)
 	defer cancel()
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
-	level := logrus.InfoLevel
-	if *debug {
-		level = logrus.DebugLevel
-	}
-	log.SetLevel(level)
-
-	app, err := NewApp(*httpAddr, *mqttAddr, log)
+	app, err := NewApp(conf, load, log)
 	if err != nil {
 		log.Fatalf("Failed to create application: %v", err)
 	}
 
+	// Reload config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Reloading config")
+			if _, err := app.Reload(); err != nil {
+				log.Errorf("Failed to reload config, keeping the current one: %v", err)
+			}
+		}
+	}()
+
 	go func() {
 		<-ctx.Done()
 		log.Info("Stopping application")
@@ -47,8 +94,8 @@ func main() {
 		}
 	}()
 
-	log.WithField("http_addr", *httpAddr).
-		WithField("mqtt_addr", *mqttAddr).
+	log.WithField("http_addr", conf.Listeners.HTTP).
+		WithField("mqtt_addr", conf.Listeners.MQTT).
 		Info("Starting...")
 	if err := app.Start(ctx); err != nil {
 		log.Fatalf("Failed to start application: %v", err)
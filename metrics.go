@@ -1,77 +1,455 @@
 package main
 
 import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
+// Metrics contains all metrics of the application, registered in its own
+// registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	// Gauges by names of sensor values, values in non-native units
+	// (see ConvertUnits) and derived metrics.
+	sensorGauges    map[string]*prometheus.GaugeVec
+	convertedGauges map[string]*prometheus.GaugeVec
+	derivedGauges   map[string]*prometheus.GaugeVec
+
+	// Names of sensor values exported in units of the Prometheus sink,
+	// see SetUnits.
+	exported   map[string]bool
+	exportedMx sync.RWMutex
+
+	// Times of the latest readings set to gauges by device, see SetLatest.
+	latest   map[string]time.Time
+	latestMx sync.Mutex
+
 	// Sensor metrics.
-	TemperatureGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_temperature_celsius",
-		Help: "Temperature in Celsius",
-	}, []string{"mac"})
-	HumidityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_humidity_percent",
-		Help: "Humidity in percent",
-	}, []string{"mac"})
-	CO2Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_co2_ppm",
-		Help: "CO2 level in parts per million",
-	}, []string{"mac"})
-	PM1Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_pm1_ugm3",
-		Help: "PM1 particulate matter in mg/m3",
-	}, []string{"mac"})
-	PM25Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_pm25_ugm3",
-		Help: "PM2.5 particulate matter in mg/m3",
-	}, []string{"mac"})
-	PM10Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_pm10_ugm3",
-		Help: "PM10 particulate matter in mg/m3",
-	}, []string{"mac"})
-	TVOCGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_tvoc_ppb",
-		Help: "Total Volatile Organic Compounds in parts per billion",
-	}, []string{"mac"})
-	RadonGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_radon_index",
-		Help: "Radon index",
-	}, []string{"mac"})
-	BatteryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "qingping_battery_percent",
-		Help: "Battery level in percent",
-	}, []string{"mac"})
+	TemperatureGauge *prometheus.GaugeVec
+	HumidityGauge    *prometheus.GaugeVec
+	CO2Gauge         *prometheus.GaugeVec
+	PM1Gauge         *prometheus.GaugeVec
+	PM25Gauge        *prometheus.GaugeVec
+	PM10Gauge        *prometheus.GaugeVec
+	TVOCGauge        *prometheus.GaugeVec
+	RadonGauge       *prometheus.GaugeVec
+	BatteryGauge     *prometheus.GaugeVec
+
+	TemperatureFahrenheitGauge *prometheus.GaugeVec
+	TVOCUGM3Gauge              *prometheus.GaugeVec
+	RadonPCILGauge             *prometheus.GaugeVec
+	RawSensorGauge             *prometheus.GaugeVec
+
+	// Derived metrics.
+	AQIUSGauge            *prometheus.GaugeVec
+	AQIEUGauge            *prometheus.GaugeVec
+	DewPointGauge         *prometheus.GaugeVec
+	AbsoluteHumidityGauge *prometheus.GaugeVec
+	HeatIndexGauge        *prometheus.GaugeVec
+	CO2CategoryGauge      *prometheus.GaugeVec
 
 	// Service metrics.
-	MessagesReceivedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "qingping_mqtt_messages_received_total",
-		Help: "Total number of MQTT messages received by message type",
-	}, []string{"type", "topic", "mac"})
-	AcksSentCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "qingping_mqtt_acks_sent_total",
-		Help: "Total number of acknowledgments sent to devices",
-	}, []string{"topic"})
-	ParseErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "qingping_mqtt_parse_errors_total",
-		Help: "Total number of message parsing errors",
-	}, []string{"topic"})
-	AckErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "qingping_mqtt_ack_errors_total",
-		Help: "Total number of acknowledgment send errors",
-	}, []string{"topic"})
-)
+	MessagesReceivedCounter *prometheus.CounterVec
+	DuplicatesCounter       *prometheus.CounterVec
+	OutOfOrderCounter       *prometheus.CounterVec
+	ClockSkewGauge          *prometheus.GaugeVec
+	ClockFixedCounter       *prometheus.CounterVec
+	TimeSyncsSentCounter    *prometheus.CounterVec
+	AcksSentCounter         *prometheus.CounterVec
+	ParseErrorsCounter      *prometheus.CounterVec
+	InvalidMessagesCounter  *prometheus.CounterVec
+	AckErrorsCounter        *prometheus.CounterVec
+
+	// MQTT connection metrics.
+	ConnectionsCounter    *prometheus.CounterVec
+	DisconnectionsCounter *prometheus.CounterVec
+	ConnectedClientsGauge *prometheus.GaugeVec
+	PacketsCounter        *prometheus.CounterVec
+
+	// Pipeline metrics.
+	PipelineQueueDepthGauge  prometheus.Gauge
+	PipelineLatencyHistogram prometheus.Histogram
+	PipelineDroppedCounter   prometheus.Counter
+
+	// Sink metrics.
+	SinkWrittenCounter *prometheus.CounterVec
+	SinkFailedCounter  *prometheus.CounterVec
+	SinkDroppedCounter *prometheus.CounterVec
+	SinkErrorsCounter  *prometheus.CounterVec
+
+	// Alert metrics.
+	AlertFiringGauge               *prometheus.GaugeVec
+	AlertNotificationsSentCounter  prometheus.Counter
+	AlertNotificationErrorsCounter prometheus.Counter
+
+	// Event stream metrics.
+	EventSubscribersGauge prometheus.Gauge
+	EventsDroppedCounter  prometheus.Counter
+}
+
+// NewMetrics creates metrics in a new registry. Go runtime and process
+// collectors are registered if enabled in the config.
+func NewMetrics(conf MetricsConfig) *Metrics {
+	reg := prometheus.NewRegistry()
+	if conf.Runtime {
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	f := promauto.With(reg)
+	m := &Metrics{
+		registry: reg,
+		latest:   make(map[string]time.Time),
+
+		// Sensor metrics.
+		TemperatureGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_temperature_celsius",
+			Help: "Temperature in Celsius",
+		}, []string{"mac"}),
+		HumidityGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_humidity_percent",
+			Help: "Humidity in percent",
+		}, []string{"mac"}),
+		CO2Gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_co2_ppm",
+			Help: "CO2 level in parts per million",
+		}, []string{"mac"}),
+		PM1Gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_pm1_ugm3",
+			Help: "PM1 particulate matter in µg/m3",
+		}, []string{"mac"}),
+		PM25Gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_pm25_ugm3",
+			Help: "PM2.5 particulate matter in µg/m3",
+		}, []string{"mac"}),
+		PM10Gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_pm10_ugm3",
+			Help: "PM10 particulate matter in µg/m3",
+		}, []string{"mac"}),
+		TVOCGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_tvoc_ppb",
+			Help: "Total Volatile Organic Compounds in parts per billion",
+		}, []string{"mac"}),
+		RadonGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_radon_bqm3",
+			Help: "Radon concentration in Bq/m3",
+		}, []string{"mac"}),
+		BatteryGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_battery_percent",
+			Help: "Battery level in percent",
+		}, []string{"mac"}),
+
+		TemperatureFahrenheitGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_temperature_fahrenheit",
+			Help: "Temperature in Fahrenheit",
+		}, []string{"mac"}),
+		TVOCUGM3Gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_tvoc_ugm3",
+			Help: "Total Volatile Organic Compounds in µg/m3, approximated from ppb",
+		}, []string{"mac"}),
+		RadonPCILGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_radon_pcil",
+			Help: "Radon concentration in pCi/L",
+		}, []string{"mac"}),
+		RawSensorGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_sensor_raw_value",
+			Help: "Sensor value before calibration, in the same unit as the calibrated metric",
+		}, []string{"mac", "field"}),
+
+		// Derived metrics.
+		AQIUSGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_aqi_us",
+			Help: "US EPA Air Quality Index from PM2.5 and PM10",
+		}, []string{"mac"}),
+		AQIEUGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_aqi_eu_level",
+			Help: "European Air Quality Index level from PM2.5 and PM10, 1 (good) to 6 (extremely poor)",
+		}, []string{"mac"}),
+		DewPointGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_dew_point_celsius",
+			Help: "Dew point in Celsius",
+		}, []string{"mac"}),
+		AbsoluteHumidityGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_absolute_humidity_gm3",
+			Help: "Absolute humidity in g/m3",
+		}, []string{"mac"}),
+		HeatIndexGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_heat_index_celsius",
+			Help: "Heat index (apparent temperature) in Celsius",
+		}, []string{"mac"}),
+		CO2CategoryGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_co2_ventilation_category",
+			Help: "Indoor air category by CO2 from EN 13779, 1 (high quality) to 4 (low quality)",
+		}, []string{"mac"}),
+
+		// Service metrics.
+		MessagesReceivedCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_messages_received_total",
+			Help: "Total number of MQTT messages received by message type",
+		}, []string{"type", "topic", "mac"}),
+		DuplicatesCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_duplicates_total",
+			Help: "Total number of dropped duplicate messages and samples",
+		}, []string{"kind"}),
+		OutOfOrderCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_out_of_order_samples_total",
+			Help: "Total number of samples older than current gauge values",
+		}, []string{"mac"}),
+		ClockSkewGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_device_clock_skew_seconds",
+			Help: "Difference between server time and device time",
+		}, []string{"mac"}),
+		ClockFixedCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_clock_fixed_samples_total",
+			Help: "Total number of samples with implausible timestamps by action taken",
+		}, []string{"action"}),
+		TimeSyncsSentCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_time_syncs_sent_total",
+			Help: "Total number of time sync commands sent to devices",
+		}, []string{"mac"}),
+		AcksSentCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_acks_sent_total",
+			Help: "Total number of acknowledgments sent to devices",
+		}, []string{"topic"}),
+		ParseErrorsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_parse_errors_total",
+			Help: "Total number of message parsing errors",
+		}, []string{"topic"}),
+		InvalidMessagesCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_invalid_messages_total",
+			Help: "Total number of messages failed validation by message type and reason",
+		}, []string{"type", "reason"}),
+		AckErrorsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_ack_errors_total",
+			Help: "Total number of acknowledgment send errors",
+		}, []string{"topic"}),
+
+		// MQTT connection metrics.
+		ConnectionsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_connections_total",
+			Help: "Total number of established MQTT connections",
+		}, []string{"listener"}),
+		DisconnectionsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_disconnections_total",
+			Help: "Total number of MQTT disconnections by reason",
+		}, []string{"listener", "reason"}),
+		ConnectedClientsGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_mqtt_connected_clients",
+			Help: "Number of currently connected MQTT clients",
+		}, []string{"listener"}),
+		PacketsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_broker_packets_total",
+			Help: "Total number of MQTT packets by direction (received, sent) and type",
+		}, []string{"direction", "type"}),
+
+		// Pipeline metrics.
+		PipelineQueueDepthGauge: f.NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_pipeline_queue_depth",
+			Help: "Number of MQTT messages waiting to be processed",
+		}),
+		PipelineLatencyHistogram: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qingping_pipeline_latency_seconds",
+			Help:    "Time from receiving an MQTT message to the end of its processing",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}),
+		PipelineDroppedCounter: f.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_pipeline_dropped_total",
+			Help: "Total number of MQTT messages dropped due to full processing queue",
+		}),
+
+		// Sink metrics.
+		SinkWrittenCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_readings_written_total",
+			Help: "Total number of readings written to sink",
+		}, []string{"sink"}),
+		SinkFailedCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_readings_failed_total",
+			Help: "Total number of readings failed to be written to sink",
+		}, []string{"sink"}),
+		SinkDroppedCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_readings_dropped_total",
+			Help: "Total number of readings dropped due to full sink queue",
+		}, []string{"sink"}),
+		SinkErrorsCounter: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_errors_total",
+			Help: "Total number of sink write errors",
+		}, []string{"sink"}),
+
+		// Alert metrics.
+		AlertFiringGauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_alert_firing",
+			Help: "Whether the alert rule is firing for the device (1) or not (0)",
+		}, []string{"rule", "mac"}),
+		AlertNotificationsSentCounter: f.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_alert_notifications_sent_total",
+			Help: "Total number of alert notifications sent to webhooks",
+		}),
+		AlertNotificationErrorsCounter: f.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_alert_notification_errors_total",
+			Help: "Total number of alert notifications failed to be sent or dropped",
+		}),
+
+		// Event stream metrics.
+		EventSubscribersGauge: f.NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_event_subscribers",
+			Help: "Number of connected event stream subscribers",
+		}),
+		EventsDroppedCounter: f.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_events_dropped_total",
+			Help: "Total number of events dropped due to slow subscribers",
+		}),
+	}
+
+	m.sensorGauges = map[string]*prometheus.GaugeVec{
+		"temperature": m.TemperatureGauge,
+		"humidity":    m.HumidityGauge,
+		"co2":         m.CO2Gauge,
+		"pm1":         m.PM1Gauge,
+		"pm25":        m.PM25Gauge,
+		"pm10":        m.PM10Gauge,
+		"tvoc":        m.TVOCGauge,
+		"radon":       m.RadonGauge,
+		"battery":     m.BatteryGauge,
+	}
+	m.convertedGauges = map[string]*prometheus.GaugeVec{
+		"temperature_fahrenheit": m.TemperatureFahrenheitGauge,
+		"tvoc_ugm3":              m.TVOCUGM3Gauge,
+		"radon_pcil":             m.RadonPCILGauge,
+	}
+	m.derivedGauges = map[string]*prometheus.GaugeVec{
+		DerivedAQIUS:            m.AQIUSGauge,
+		DerivedAQIEU:            m.AQIEUGauge,
+		DerivedDewPoint:         m.DewPointGauge,
+		DerivedAbsoluteHumidity: m.AbsoluteHumidityGauge,
+		DerivedHeatIndex:        m.HeatIndexGauge,
+		DerivedCO2Category:      m.CO2CategoryGauge,
+	}
+	m.SetUnits(UnitsConfig{})
+	return m
+}
+
+// Register adds a custom collector to the registry.
+func (m *Metrics) Register(c prometheus.Collector) error {
+	return m.registry.Register(c) //nolint:wrapcheck
+}
+
+// Handler returns HTTP handler that exposes metrics of the registry.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// SetUnits sets units of sensor values exported as metrics. Series
+// of values in units that are not exported anymore are removed, and
+// values in these units are skipped, e.g. ones written by a sink that
+// is being replaced on reload.
+func (m *Metrics) SetUnits(units UnitsConfig) {
+	exported := make(map[string]bool)
+	for _, field := range units.Fields() {
+		exported[field] = true
+	}
+
+	m.exportedMx.Lock()
+	defer m.exportedMx.Unlock()
+	m.exported = exported
+	for _, gauges := range []map[string]*prometheus.GaugeVec{m.sensorGauges, m.convertedGauges} {
+		for field, g := range gauges {
+			if !exported[field] {
+				g.Reset()
+				m.RawSensorGauge.DeletePartialMatch(prometheus.Labels{"field": field})
+			}
+		}
+	}
+}
+
+// Set sets metrics from provided sensor values, and metrics
+// derived from them. Values in units that are not exported are skipped.
+func (m *Metrics) Set(mac string, fields, derived map[string]float64) {
+	m.exportedMx.RLock()
+	defer m.exportedMx.RUnlock()
+	for field, value := range fields {
+		raw, isRaw := strings.CutSuffix(field, RawSuffix)
+		if !m.exported[raw] {
+			continue
+		}
+		if g, ok := m.sensorGauges[field]; ok {
+			g.WithLabelValues(mac).Set(value)
+		}
+		if g, ok := m.convertedGauges[field]; ok {
+			g.WithLabelValues(mac).Set(value)
+		}
+		if isRaw {
+			m.RawSensorGauge.WithLabelValues(mac, raw).Set(value)
+		}
+	}
+	for field, value := range derived {
+		m.derivedGauges[field].WithLabelValues(mac).Set(value)
+	}
+}
+
+// Reset sets exported sensor metrics and derived metrics of the device
+// to zero. Other metrics of the device are removed.
+func (m *Metrics) Reset(mac string) {
+	m.exportedMx.RLock()
+	defer m.exportedMx.RUnlock()
+	for _, gauges := range []map[string]*prometheus.GaugeVec{m.sensorGauges, m.convertedGauges} {
+		for field, g := range gauges {
+			if m.exported[field] {
+				g.WithLabelValues(mac).Set(0)
+			} else {
+				g.DeleteLabelValues(mac)
+			}
+		}
+	}
+	for _, g := range m.derivedGauges {
+		g.WithLabelValues(mac).Set(0)
+	}
+	m.RawSensorGauge.DeletePartialMatch(prometheus.Labels{"mac": mac})
+}
+
+// SetLatest sets gauges to values of the reading, unless values of a newer
+// reading of the device are already set. Returns false if the reading
+// is skipped.
+func (m *Metrics) SetLatest(r Reading) bool {
+	m.latestMx.Lock()
+	defer m.latestMx.Unlock()
+	if r.Time.Before(m.latest[r.MAC]) {
+		return false
+	}
+	m.latest[r.MAC] = r.Time
+	m.Set(r.MAC, r.Fields, r.Derived)
+	return true
+}
+
+// PrometheusSink is a sink that exposes readings as Prometheus gauges.
+// Gauges show the current state, so readings older than the ones already
+// applied are skipped. This happens when a delayed history message comes
+// after a real-time one. Times of applied readings are kept in metrics,
+// so they are shared with the sink that replaces this one on reload.
+type PrometheusSink struct {
+	metrics *Metrics
+}
+
+// NewPrometheusSink creates a new Prometheus sink.
+func NewPrometheusSink(metrics *Metrics) *PrometheusSink {
+	return &PrometheusSink{metrics: metrics}
+}
 
-// SetMetrics sets metrics from provided sensor data.
-func SetMetrics(mac string, data SensorData) {
-	TemperatureGauge.WithLabelValues(mac).Set(data.Temperature.Value)
-	HumidityGauge.WithLabelValues(mac).Set(data.Humidity.Value)
-	CO2Gauge.WithLabelValues(mac).Set(data.CO2.Value)
-	PM1Gauge.WithLabelValues(mac).Set(data.PM1.Value)
-	PM25Gauge.WithLabelValues(mac).Set(data.PM25.Value)
-	PM10Gauge.WithLabelValues(mac).Set(data.PM10.Value)
-	TVOCGauge.WithLabelValues(mac).Set(data.TVOC.Value)
-	RadonGauge.WithLabelValues(mac).Set(data.Radon.Value)
-	BatteryGauge.WithLabelValues(mac).Set(data.Battery.Value)
+// Write sets gauges to values of the readings.
+func (s *PrometheusSink) Write(readings []Reading) error {
+	for _, r := range readings {
+		if !s.metrics.SetLatest(r) {
+			s.metrics.OutOfOrderCounter.WithLabelValues(r.MAC).Inc()
+		}
+	}
+	return nil
 }
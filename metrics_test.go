@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("instances are independent", func(t *testing.T) {
+		m1 := NewMetrics(MetricsConfig{})
+		m2 := NewMetrics(MetricsConfig{})
+
+		m1.Set("112233445566", map[string]float64{"co2": 850}, nil)
+		m1.ParseErrorsCounter.WithLabelValues("qingping/test/up").Inc()
+
+		if !gathered(t, m1, "qingping_co2_ppm") {
+			t.Fatal("Expected co2 metric in the first registry")
+		}
+		if gathered(t, m2, "qingping_co2_ppm") {
+			t.Fatal("Unexpected co2 metric in the second registry")
+		}
+		if gathered(t, m2, "qingping_mqtt_parse_errors_total") {
+			t.Fatal("Unexpected parse errors metric in the second registry")
+		}
+	})
+
+	t.Run("runtime collectors", func(t *testing.T) {
+		if gathered(t, NewMetrics(MetricsConfig{}), "go_goroutines") {
+			t.Fatal("Unexpected runtime metrics")
+		}
+		if !gathered(t, NewMetrics(MetricsConfig{Runtime: true}), "go_goroutines") {
+			t.Fatal("Expected runtime metrics")
+		}
+	})
+
+	t.Run("latest readings are shared by sinks", func(t *testing.T) {
+		m := NewMetrics(MetricsConfig{})
+		now := time.Now()
+		old, replacement := NewPrometheusSink(m), NewPrometheusSink(m)
+
+		mac := "112233445566"
+		old.Write([]Reading{{MAC: mac, Time: now, Fields: map[string]float64{"co2": 850}}})
+		replacement.Write([]Reading{{MAC: mac, Time: now.Add(-time.Minute), Fields: map[string]float64{"co2": 900}}})
+
+		if v := testutil.ToFloat64(m.CO2Gauge.WithLabelValues(mac)); v != 850 {
+			t.Fatalf("Expected co2 850, got %v", v)
+		}
+		if v := testutil.ToFloat64(m.OutOfOrderCounter.WithLabelValues(mac)); v != 1 {
+			t.Fatalf("Expected 1 out of order reading, got %v", v)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		m := NewMetrics(MetricsConfig{})
+		m.SetUnits(UnitsConfig{Temperature: []string{UnitFahrenheit}})
+		m.Set("112233445566", map[string]float64{"co2": 850, "temperature_fahrenheit": 74}, nil)
+		m.Reset("112233445566")
+
+		if gathered(t, m, "qingping_temperature_celsius") {
+			t.Fatal("Unexpected metric in unit that is not exported")
+		}
+		if v := testutil.ToFloat64(m.TemperatureFahrenheitGauge.WithLabelValues("112233445566")); v != 0 {
+			t.Fatalf("Expected temperature to be reset to 0, got %v", v)
+		}
+		if v := testutil.ToFloat64(m.CO2Gauge.WithLabelValues("112233445566")); v != 0 {
+			t.Fatalf("Expected co2 to be reset to 0, got %v", v)
+		}
+	})
+
+	t.Run("units change", func(t *testing.T) {
+		m := NewMetrics(MetricsConfig{})
+		m.SetUnits(UnitsConfig{Temperature: []string{UnitCelsius, UnitFahrenheit}})
+		m.Set("112233445566", map[string]float64{
+			"temperature": 25, "temperature_fahrenheit": 77, "temperature_fahrenheit_raw": 78,
+		}, nil)
+
+		m.SetUnits(UnitsConfig{})
+		if gathered(t, m, "qingping_temperature_fahrenheit") || gathered(t, m, "qingping_sensor_raw_value") {
+			t.Fatal("Expected metrics in removed unit to be deleted")
+		}
+		if v := testutil.ToFloat64(m.TemperatureGauge.WithLabelValues("112233445566")); v != 25 {
+			t.Fatalf("Expected temperature 25, got %v", v)
+		}
+
+		// Late values in the removed unit are skipped
+		m.Set("112233445566", map[string]float64{"temperature_fahrenheit": 80}, nil)
+		if gathered(t, m, "qingping_temperature_fahrenheit") {
+			t.Fatal("Unexpected metric in removed unit")
+		}
+	})
+}
+
+// gathered reports whether the registry has samples of the metric.
+func gathered(t *testing.T, m *Metrics, name string) bool {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() == name && len(f.GetMetric()) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -2,149 +2,133 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
-	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/sirupsen/logrus"
-)
-
-// HeartbeatInterval is the expected interval of heartbeats from the device.
-var HeartbeatInterval = 1 * time.Minute
 
-// List of message types.
-// https://developer.qingping.co/private/communication-protocols/public-mqtt-json
-const (
-	BLEConnectionRequestType        = "1"
-	BLEDisconnectionRequestType     = "2"
-	BLEOpenNotificationRequestType  = "3"
-	BLECloseNotificationRequestType = "4"
-	BLENotificationResponseType     = "5"
-	BLEDataWithResponseType         = "6"
-	BLEReadDataType                 = "7"
-	BLEDataResponseType             = "8"
-	BroadcastDataType               = "9"
-	DeviceListRequestType           = "10"
-	DeviceListResponseType          = "11"
-	RealTimeSensorDataType          = "12"
-	HeartbeatType                   = "13"
-	MQTTReconnectType               = "14"
-	BLEDataWithoutResponseType      = "15"
-	MQTTConnectionSettingType       = "16"
-	HistorySensorDataType           = "17"
-	HistoryDataResponseType         = "18"
-	DeviceLogReportType             = "19"
-	BindingStatusType               = "20"
-	OTACommandType                  = "23"
-	OTAResponseType                 = "24"
-	DeviceListWithNameRequestType   = "25"
-	DeviceListWithNameResponseType  = "26"
-	ThirdPartyBindingStatusType     = "27"
-	DeviceSettingReadRequestType    = "28"
+	"github.com/tetafro/qingping-mqtt/qingping"
 )
 
 // AllowedMessageTypes is the list of message types that the app can process.
 var AllowedMessageTypes = []string{
-	HeartbeatType,
-	RealTimeSensorDataType,
-	HistorySensorDataType,
+	qingping.HeartbeatType,
+	qingping.RealTimeSensorDataType,
+	qingping.HistorySensorDataType,
 }
 
+// Validation modes of messages, see qingping.Validate.
+const (
+	ValidationLenient = "lenient" // count invalid messages and process them
+	ValidationStrict  = "strict"  // count invalid messages and drop them
+)
+
 // MQTTBroker wraps the MQTT server and provides message handling.
 type MQTTBroker struct {
-	server  *mqtt.Server
-	clients map[string]time.Time
-	mx      sync.Mutex
-	log     *logrus.Logger
-}
-
-// QingpingMessage represents the message envelope from Qingping devices.
-type QingpingMessage struct {
-	ID         int          `json:"id"`
-	Type       string       `json:"type"`
-	NeedAck    int          `json:"need_ack"`
-	MAC        string       `json:"mac"`      // set in sensor data messages
-	WifiMAC    string       `json:"wifi_mac"` // set in heartbeat messages
-	Timestamp  int64        `json:"timestamp"`
-	SensorData []SensorData `json:"sensorData"`
-}
-
-// SensorData represents sensor readings in type "12" and "17" messages.
-type SensorData struct {
-	Timestamp   ValueWrapper `json:"timestamp"`
-	Temperature ValueWrapper `json:"temperature"`
-	Humidity    ValueWrapper `json:"humidity"`
-	CO2         ValueWrapper `json:"co2"`
-	PM1         ValueWrapper `json:"pm1"`
-	PM25        ValueWrapper `json:"pm25"`
-	PM10        ValueWrapper `json:"pm10"`
-	TVOC        ValueWrapper `json:"tvoc"`
-	Radon       ValueWrapper `json:"radon"`
-	Battery     ValueWrapper `json:"battery"`
-}
-
-// ValueWrapper wraps sensor values with optional additional fields.
-// Most fields from the spec are omitted, as they are not used.
-type ValueWrapper struct {
-	Value float64 `json:"value"`
-}
-
-// AckResponse represents the acknowledgment message sent back to the device.
-type AckResponse struct {
-	Type      string `json:"type"`
-	AckID     int    `json:"ack_id"`
-	Code      int    `json:"code"`
-	Timestamp int64  `json:"timestamp"`
-	Desc      string `json:"desc,omitempty"`
+	server   *mqtt.Server
+	auth     *AuthHook
+	listener *servingListener
+	pipeline *Pipeline
+	liveness LivenessConfig
+	clients  map[string]time.Time // last message time of alive devices
+	states   *DeviceStates
+	events   *Events
+	metrics  *Metrics
+	serving  atomic.Bool
+	received atomic.Int64 // unix time of the last message in nanoseconds
+	mx       sync.Mutex
+	log      *logrus.Logger
 }
 
 // NewMQTTBroker creates and configures a new MQTT broker.
-func NewMQTTBroker(addr string, log *logrus.Logger) (*MQTTBroker, error) {
+func NewMQTTBroker(
+	conf Config,
+	states *DeviceStates,
+	events *Events,
+	metrics *Metrics,
+	store StoreFunc,
+	log *logrus.Logger,
+) (*MQTTBroker, error) {
 	opts := &mqtt.Options{
 		InlineClient: true, // allow publishing from within hooks
 		Logger:       slog.New(slog.DiscardHandler),
 	}
 	broker := &MQTTBroker{
-		server:  mqtt.New(opts),
-		clients: make(map[string]time.Time),
-		log:     log,
+		server:   mqtt.New(opts),
+		auth:     NewAuthHook(conf.Auth),
+		liveness: conf.Liveness,
+		clients:  make(map[string]time.Time),
+		states:   states,
+		events:   events,
+		metrics:  metrics,
+		log:      log,
+	}
+
+	err := broker.server.AddHook(broker.auth, nil)
+	if err != nil {
+		return nil, fmt.Errorf("add auth hook: %w", err)
 	}
 
-	// Allow all connections (no authentication for simplicity)
-	err := broker.server.AddHook(new(auth.AllowHook), nil)
+	err = broker.server.AddHook(&ConnectionsHook{metrics: metrics}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("add connections hook: %w", err)
+	}
+	err = broker.server.AddHook(&PacketsHook{metrics: metrics}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("add packets hook: %w", err)
+	}
+	err = metrics.Register(NewBrokerCollector(broker.server))
 	if err != nil {
-		return nil, fmt.Errorf("add allow-all hook: %w", err)
+		return nil, fmt.Errorf("register broker metrics: %w", err)
 	}
 
 	// Add message handler hook
 	hook := &MessageHook{
+		dedup:   NewDedup(conf.Pipeline.DedupWindow, metrics),
+		clock:   NewClockMonitor(conf.Clock, metrics),
+		strict:  conf.Pipeline.Validation == ValidationStrict,
 		publish: broker.server.Publish,
+		received: func(t time.Time) {
+			broker.received.Store(t.UnixNano())
+		},
 		alive: func(mac string) {
+			now := time.Now()
 			broker.mx.Lock()
-			broker.clients[mac] = time.Now()
+			_, online := broker.clients[mac]
+			broker.clients[mac] = now
 			broker.mx.Unlock()
+			states.Alive(mac, now)
+			if !online {
+				events.Publish(Event{Type: EventOnline, MAC: mac})
+			}
 		},
-		log: log,
+		states:  states,
+		events:  events,
+		metrics: metrics,
+		store:   store,
+		log:     log,
 	}
+	broker.pipeline = NewPipeline(conf.Pipeline, hook.process, metrics)
+	hook.push = broker.pipeline.Push
 	err = broker.server.AddHook(hook, nil)
 	if err != nil {
 		return nil, fmt.Errorf("add processing hook: %w", err)
 	}
 
 	// Create TCP listener
-	tcp := listeners.NewTCP(listeners.Config{
+	broker.listener = &servingListener{Listener: listeners.NewTCP(listeners.Config{
 		ID:      "tcp",
-		Address: addr,
-	})
-	err = broker.server.AddListener(tcp)
+		Address: conf.Listeners.MQTT,
+	})}
+	err = broker.server.AddListener(broker.listener)
 	if err != nil {
 		return nil, fmt.Errorf("add listener: %w", err)
 	}
@@ -156,7 +140,7 @@ func NewMQTTBroker(addr string, log *logrus.Logger) (*MQTTBroker, error) {
 func (b *MQTTBroker) Start(ctx context.Context) error {
 	// Check liveness of devices in a background loop
 	go func() {
-		ticker := time.NewTicker(HeartbeatInterval / 10)
+		ticker := time.NewTicker(b.liveness.HeartbeatInterval / 10)
 		defer ticker.Stop()
 		for range ticker.C {
 			if err := ctx.Err(); err != nil {
@@ -165,9 +149,11 @@ func (b *MQTTBroker) Start(ctx context.Context) error {
 			b.mx.Lock()
 			for mac, lastSeen := range b.clients {
 				since := time.Since(lastSeen)
-				if since > 3*HeartbeatInterval {
+				if since > b.liveness.Timeout() {
 					b.log.WithFields(logrus.Fields{"mac": mac}).Debugf("Client is dead")
-					SetMetrics(mac, SensorData{})
+					b.metrics.Reset(mac)
+					b.states.Offline(mac)
+					b.events.Publish(Event{Type: EventOffline, MAC: mac})
 					delete(b.clients, mac)
 				}
 			}
@@ -175,28 +161,106 @@ func (b *MQTTBroker) Start(ctx context.Context) error {
 		}
 	}()
 
-	return b.server.Serve() //nolint:wrapcheck
+	b.pipeline.Start()
+	if err := b.server.Serve(); err != nil {
+		return err //nolint:wrapcheck
+	}
+	b.serving.Store(true)
+	return nil
+}
+
+// BrokerStatus describes the state of the broker.
+type BrokerStatus struct {
+	Serving          bool              `json:"serving"`
+	Listeners        map[string]string `json:"listeners"` // addresses of listeners accepting connections by ID
+	ClientsConnected int64             `json:"clients_connected"`
+	Started          time.Time         `json:"started,omitzero"`
+	LastMessage      time.Time         `json:"last_message,omitzero"`
+}
+
+// Status returns the current state of the broker.
+func (b *MQTTBroker) Status() BrokerStatus {
+	status := BrokerStatus{
+		Serving:          b.serving.Load(),
+		Listeners:        map[string]string{},
+		ClientsConnected: atomic.LoadInt64(&b.server.Info.ClientsConnected),
+	}
+	if b.listener.serving.Load() {
+		status.Listeners[b.listener.ID()] = b.listener.Address()
+	}
+	if sec := atomic.LoadInt64(&b.server.Info.Started); sec > 0 {
+		status.Started = time.Unix(sec, 0).UTC()
+	}
+	if ns := b.received.Load(); ns > 0 {
+		status.LastMessage = time.Unix(0, ns).UTC()
+	}
+	return status
+}
+
+// servingListener is a listener that tracks whether it accepts
+// connections. The accept loop stops when the listener is closed
+// or fails.
+type servingListener struct {
+	listeners.Listener
+	serving atomic.Bool
 }
 
-// Stop stops the MQTT broker.
+// Serve accepts connections until the listener is closed or fails.
+func (l *servingListener) Serve(establish listeners.EstablishFn) {
+	l.serving.Store(true)
+	defer l.serving.Store(false)
+	l.Listener.Serve(establish)
+}
+
+// Publish publishes a message from the broker itself.
+func (b *MQTTBroker) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	return b.server.Publish(topic, payload, retain, qos) //nolint:wrapcheck
+}
+
+// SetAuth replaces authentication and ACL rules. Connected clients are
+// not dropped, new rules apply to their next publish or subscribe.
+func (b *MQTTBroker) SetAuth(conf AuthConfig) {
+	b.auth.Set(conf)
+}
+
+// Stop stops the MQTT broker and waits for received messages
+// to be processed.
 func (b *MQTTBroker) Stop() error {
-	return b.server.Close() //nolint:wrapcheck
+	b.serving.Store(false)
+	err := b.server.Close()
+	b.pipeline.Stop()
+	return err //nolint:wrapcheck
 }
 
 // MessageHook handles MQTT message events.
 type MessageHook struct {
 	mqtt.HookBase
-	publish PublishFunc
-	alive   AliveFunc
-	log     *logrus.Logger
+	push     PushFunc
+	dedup    *Dedup
+	clock    *ClockMonitor
+	strict   bool
+	publish  PublishFunc
+	received func(t time.Time)
+	alive    AliveFunc
+	states   *DeviceStates
+	events   *Events
+	metrics  *Metrics
+	store    StoreFunc
+	log      *logrus.Logger
 }
 
+// PushFunc puts a message to the processing queue.
+type PushFunc func(msg Message) bool
+
 // PublishFunc describes sending message to topics.
 type PublishFunc func(topic string, payload []byte, retain bool, qos byte) error
 
 // AliveFunc marks a client as alive.
 type AliveFunc func(mac string)
 
+// StoreFunc passes readings to sinks.
+type StoreFunc func(readings ...Reading)
+
 // ID returns the hook ID.
 func (h *MessageHook) ID() string {
 	return "message-handler"
@@ -208,88 +272,201 @@ func (h *MessageHook) Provides(flag byte) bool {
 }
 
 // OnPublish is called when a message is published to the broker.
-func (h *MessageHook) OnPublish(_ *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+func (h *MessageHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	// Skip messages published by the broker itself: acks and republished readings
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
 	h.log.WithFields(logrus.Fields{
 		"topic":   pk.TopicName,
 		"payload": string(pk.Payload),
 	}).Debug("Received MQTT message")
 
-	// Parse the message envelope
-	var msg QingpingMessage
-	if err := json.Unmarshal(pk.Payload, &msg); err != nil {
+	now := time.Now()
+	h.received(now)
+	ok := h.push(Message{
+		Topic:      pk.TopicName,
+		Payload:    slices.Clone(pk.Payload),
+		ClientID:   cl.ID,
+		RemoteAddr: cl.Net.Remote,
+		Received:   now,
+	})
+	if !ok {
+		h.log.WithField("topic", pk.TopicName).Warn("Dropped message: processing queue is full")
+	}
+
+	return pk, nil
+}
+
+// process handles a message from the processing queue.
+func (h *MessageHook) process(m Message) {
+	// Parse the message envelope, values of wrong types are skipped
+	// and reported as invalid
+	msg, err := qingping.Decode(m.Payload)
+	var verr *qingping.ValidationError
+	if err != nil && !errors.As(err, &verr) {
 		h.log.WithError(err).Error("Failed to parse message")
-		ParseErrorsCounter.WithLabelValues(pk.TopicName).Inc()
-		return pk, nil
+		h.metrics.ParseErrorsCounter.WithLabelValues(m.Topic).Inc()
+		h.events.Publish(Event{
+			Type: EventParseError,
+			Data: ParseErrorEvent{Topic: m.Topic, Error: err.Error()},
+		})
+		return
+	}
+
+	mac := msg.DeviceMAC()
+
+	if !h.validate(m.Topic, msg, err) {
+		if msg.AckRequired() {
+			h.sendAcknowledgment(m.Topic, mac, msg.ID)
+		}
+		return
 	}
 
-	// In different types of messages MAC address is set in defferent fields
-	mac := msg.MAC
-	if msg.WifiMAC != "" {
-		mac = msg.WifiMAC
+	// Devices resend messages when they don't get an acknowledgment in time
+	if h.dedup.Message(mac, msg.ID) {
+		h.log.WithFields(logrus.Fields{"mac": mac, "msg_id": msg.ID}).Debug("Dropping duplicate message")
+		h.metrics.DuplicatesCounter.WithLabelValues("message").Inc()
+		if msg.AckRequired() {
+			h.sendAcknowledgment(m.Topic, mac, msg.ID)
+		}
+		return
 	}
 
-	MessagesReceivedCounter.WithLabelValues(msg.Type, pk.TopicName, mac).Inc()
+	h.metrics.MessagesReceivedCounter.WithLabelValues(msg.Type, m.Topic, mac).Inc()
+	h.states.Received(mac, msg.Type, m.ClientID, m.RemoteAddr)
 
 	if !slices.Contains(AllowedMessageTypes, msg.Type) {
 		h.log.WithField("type", msg.Type).Debug("Ignoring message type")
-		return pk, nil
+		return
 	}
 
 	// Mark the device as alive
 	h.alive(mac)
 
+	// Check device clock
+	now := time.Now()
+	skew, measured := h.clock.Skew(mac, msg.Timestamp, now)
+	if h.clock.NeedSync(mac, skew, now) {
+		h.sendTimeSync(m.Topic, mac)
+	}
+
 	// Do nothing on heartbeat
-	if msg.Type == HeartbeatType {
-		return pk, nil
+	if msg.Type == qingping.HeartbeatType {
+		return
 	}
 
-	// Take the latest data
-	if len(msg.SensorData) > 0 {
-		var data SensorData
-		var latest float64
-		for _, d := range msg.SensorData {
-			if d.Timestamp.Value >= latest {
-				latest = d.Timestamp.Value
-				data = d
-			}
+	// Pass the data to sinks
+	data := h.dedup.SensorData(mac, msg.SensorData)
+	data = h.clock.Fix(data, skew, measured, now)
+	if len(data) > 0 {
+		list := readings(mac, data)
+		h.store(list...)
+		for _, r := range list {
+			h.events.Publish(Event{Type: EventReading, MAC: mac, Data: r})
 		}
-		SetMetrics(mac, data)
 	}
 
-	if msg.NeedAck == 1 {
-		h.sendAcknowledgment(pk.TopicName, msg.ID)
+	if msg.AckRequired() {
+		h.sendAcknowledgment(m.Topic, mac, msg.ID)
 	}
+}
 
-	return pk, nil
+// validate checks the message and counts invalid ones, including
+// the error of decoding values of wrong types. Returns false if the message
+// must be dropped. Dropped messages are acknowledged, so
+// devices don't send them again.
+func (h *MessageHook) validate(topic string, msg qingping.Message, decodeErr error) bool {
+	err := decodeErr
+	if err == nil {
+		err = qingping.Validate(msg)
+	}
+	var verr *qingping.ValidationError
+	if !errors.As(err, &verr) {
+		return true
+	}
+	h.metrics.InvalidMessagesCounter.WithLabelValues(msg.Type, verr.Reason).Inc()
+	log := h.log.WithError(err).WithFields(logrus.Fields{
+		"topic":  topic,
+		"type":   msg.Type,
+		"msg_id": msg.ID,
+	})
+	if h.strict {
+		log.Warn("Dropping invalid message")
+		return false
+	}
+	log.Debug("Received invalid message")
+	return true
+}
+
+// readings converts sensor data of the device to readings sorted by time.
+// Data without a timestamp is considered to be measured right now.
+func readings(mac string, data []qingping.SensorData) []Reading {
+	now := time.Now().UTC()
+	list := make([]Reading, 0, len(data))
+	for _, d := range data {
+		t, ok := d.Time()
+		if !ok {
+			t = now
+		}
+		list = append(list, Reading{MAC: mac, Time: t.UTC(), Fields: d.Fields()})
+	}
+	slices.SortStableFunc(list, func(a, b Reading) int {
+		return a.Time.Compare(b.Time)
+	})
+	return list
 }
 
 // sendAcknowledgment sends an acknowledgment message back to the device.
-func (h *MessageHook) sendAcknowledgment(upTopic string, msgID int) {
-	downTopic := strings.Replace(upTopic, "/up", "/down", 1)
+func (h *MessageHook) sendAcknowledgment(upTopic, mac string, msgID int) {
+	downTopic := qingping.DownTopic(upTopic)
 	log := h.log.WithFields(logrus.Fields{
 		"msg_id": msgID,
 		"topic":  downTopic,
 	})
 
-	ack := AckResponse{
-		Type:      "18",
-		AckID:     msgID,
-		Timestamp: time.Now().Unix(),
-	}
-
-	payload, err := json.Marshal(ack)
+	payload, err := qingping.Encode(qingping.Ack(msgID, time.Now()))
 	if err != nil {
 		log.WithError(err).Error("Failed to marshal acknowledgment")
-		AckErrorsCounter.WithLabelValues(downTopic).Inc()
+		h.metrics.AckErrorsCounter.WithLabelValues(downTopic).Inc()
 		return
 	}
 
 	if err := h.publish(downTopic, payload, false, 0); err != nil {
 		log.WithError(err).Error("Failed to publish acknowledgment")
-		AckErrorsCounter.WithLabelValues(downTopic).Inc()
+		h.metrics.AckErrorsCounter.WithLabelValues(downTopic).Inc()
 		return
 	}
 
-	AcksSentCounter.WithLabelValues(upTopic).Inc()
+	h.metrics.AcksSentCounter.WithLabelValues(upTopic).Inc()
+	h.events.Publish(Event{
+		Type: EventAck,
+		MAC:  mac,
+		Data: AckEvent{Topic: downTopic, MsgID: msgID},
+	})
 	log.Debug("Sent acknowledgment")
 }
+
+// sendTimeSync sends the current server time to the device.
+func (h *MessageHook) sendTimeSync(upTopic, mac string) {
+	downTopic := qingping.DownTopic(upTopic)
+	log := h.log.WithFields(logrus.Fields{
+		"mac":   mac,
+		"topic": downTopic,
+	})
+
+	payload, err := qingping.Encode(qingping.TimeSync(time.Now()))
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal time sync")
+		return
+	}
+
+	if err := h.publish(downTopic, payload, false, 0); err != nil {
+		log.WithError(err).Error("Failed to publish time sync")
+		return
+	}
+
+	h.metrics.TimeSyncsSentCounter.WithLabelValues(mac).Inc()
+	log.Info("Sent time sync")
+}
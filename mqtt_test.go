@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMessageHookValidation(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+
+	testCases := []struct {
+		name    string
+		strict  bool
+		payload string
+		stored  int
+		acks    int
+		invalid []string // type and reason of invalid message
+	}{
+		{
+			name:    "valid message",
+			strict:  true,
+			payload: `{"type": "12", "id": 1, "need_ack": 1, "mac": "112233445566", "sensorData": [{"co2": {"value": 850}}]}`,
+			stored:  1,
+			acks:    1,
+		},
+		{
+			name:    "lenient mode keeps invalid message",
+			payload: `{"type": "12", "id": 1, "mac": "112233445566", "sensorData": [{"co2": {"value": -1}}]}`,
+			stored:  1,
+			invalid: []string{"12", "value_out_of_range"},
+		},
+		{
+			name:    "strict mode drops invalid message",
+			strict:  true,
+			payload: `{"type": "17", "id": 1, "need_ack": 1, "sensorData": [{"timestamp": {"value": 1700000000}}]}`,
+			acks:    1,
+			invalid: []string{"17", "missing_mac"},
+		},
+		{
+			name: "lenient mode skips values of wrong types",
+			payload: `{"type": "12", "id": 1, "mac": "112233445566",` +
+				`"sensorData": [{"co2": {"value": 850}, "humidity": {"value": "x"}}]}`,
+			stored:  1,
+			invalid: []string{"12", "bad_type"},
+		},
+		{
+			name:    "strict mode drops values of wrong types",
+			strict:  true,
+			payload: `{"type": "12", "id": 1, "need_ack": 1, "mac": 123, "sensorData": [{"co2": {"value": 850}}]}`,
+			acks:    1,
+			invalid: []string{"12", "bad_type"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewMetrics(MetricsConfig{})
+			var stored, acks int
+			h := &MessageHook{
+				dedup:  NewDedup(time.Hour, metrics),
+				clock:  NewClockMonitor(ClockConfig{Policy: ClockPolicyKeep}, metrics),
+				strict: tc.strict,
+				publish: func(string, []byte, bool, byte) error {
+					acks++
+					return nil
+				},
+				received: func(time.Time) {},
+				alive:    func(string) {},
+				states:   NewDeviceStates(Devices{}),
+				events:   NewEvents(metrics),
+				metrics:  metrics,
+				store:    func(r ...Reading) { stored += len(r) },
+				log:      log,
+			}
+			h.process(Message{Topic: "qingping/office/up", Payload: []byte(tc.payload)})
+
+			if stored != tc.stored || acks != tc.acks {
+				t.Fatalf("Expected %d readings and %d acks, got %d and %d", tc.stored, tc.acks, stored, acks)
+			}
+			if n := testutil.CollectAndCount(metrics.ParseErrorsCounter); n != 0 {
+				t.Fatalf("Unexpected parse errors: %d", n)
+			}
+			if tc.invalid == nil {
+				if n := testutil.CollectAndCount(metrics.InvalidMessagesCounter); n != 0 {
+					t.Fatalf("Unexpected invalid messages: %d", n)
+				}
+				return
+			}
+			if v := testutil.ToFloat64(metrics.InvalidMessagesCounter.WithLabelValues(tc.invalid...)); v != 1 {
+				t.Fatalf("Expected 1 invalid message %v, got %v", tc.invalid, v)
+			}
+		})
+	}
+}
+
+func TestServingListener(t *testing.T) {
+	l := &servingListener{Listener: listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})}
+	if err := l.Init(slog.New(slog.DiscardHandler)); err != nil {
+		t.Fatalf("Failed to init listener: %v", err)
+	}
+	if l.serving.Load() {
+		t.Fatal("Expected listener not to serve before start")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.Serve(func(string, net.Conn) error { return nil })
+		close(done)
+	}()
+	for i := 0; !l.serving.Load(); i++ {
+		if i == 100 {
+			t.Fatal("Expected listener to serve")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	l.Close(func(string) {})
+	<-done
+	if l.serving.Load() {
+		t.Fatal("Expected listener not to serve after close")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Message is a received MQTT message waiting to be processed.
+type Message struct {
+	Topic      string
+	Payload    []byte
+	ClientID   string
+	RemoteAddr string
+	Received   time.Time
+}
+
+// HandleFunc processes a message.
+type HandleFunc func(msg Message)
+
+// Pipeline is a bounded queue with a pool of workers that processes
+// messages outside of the broker's publish path.
+//
+// Every worker has its own queue, and messages are assigned to workers
+// by topic, as payloads are not parsed yet. A device publishes to a single
+// up topic, so its messages are processed in the order they were received.
+// This assumes one topic per device: devices sharing a topic are handled
+// by a single worker.
+type Pipeline struct {
+	queues  []chan Message
+	handle  HandleFunc
+	metrics *Metrics
+	closed  bool
+	mx      sync.RWMutex
+	wg      sync.WaitGroup
+}
+
+// NewPipeline creates a new pipeline. The queue size is split between
+// workers.
+func NewPipeline(conf PipelineConfig, handle HandleFunc, metrics *Metrics) *Pipeline {
+	p := &Pipeline{
+		queues:  make([]chan Message, conf.Workers),
+		handle:  handle,
+		metrics: metrics,
+	}
+	size := max(conf.QueueSize/conf.Workers, 1)
+	for i := range p.queues {
+		p.queues[i] = make(chan Message, size)
+	}
+	return p
+}
+
+// Start starts the workers.
+func (p *Pipeline) Start() {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range queue {
+				p.metrics.PipelineQueueDepthGauge.Dec()
+				p.handle(msg)
+				p.metrics.PipelineLatencyHistogram.Observe(time.Since(msg.Received).Seconds())
+			}
+		}()
+	}
+}
+
+// Push puts the message to the queue without blocking. The message is
+// dropped if the queue is full or the pipeline is stopped.
+func (p *Pipeline) Push(msg Message) bool {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+
+	if p.closed {
+		p.metrics.PipelineDroppedCounter.Inc()
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic)) //nolint:errcheck,gosec
+	p.metrics.PipelineQueueDepthGauge.Inc()
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- msg: //nolint:gosec
+		return true
+	default:
+		p.metrics.PipelineQueueDepthGauge.Dec()
+		p.metrics.PipelineDroppedCounter.Inc()
+		return false
+	}
+}
+
+// Len returns the number of messages waiting in the queue.
+func (p *Pipeline) Len() int {
+	var n int
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Stop stops accepting new messages and waits for queued messages
+// to be processed.
+func (p *Pipeline) Stop() {
+	p.mx.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mx.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	var mx sync.Mutex
+	processed := map[string][]int{}
+	p := NewPipeline(PipelineConfig{Workers: 4, QueueSize: 400}, func(msg Message) {
+		n, _ := strconv.Atoi(string(msg.Payload))
+		mx.Lock()
+		processed[msg.Topic] = append(processed[msg.Topic], n)
+		mx.Unlock()
+	}, NewMetrics(MetricsConfig{}))
+	p.Start()
+
+	topics := []string{"qingping/a/up", "qingping/b/up", "qingping/c/up"}
+	for i := range 50 {
+		for _, topic := range topics {
+			if !p.Push(Message{Topic: topic, Payload: []byte(strconv.Itoa(i))}) {
+				t.Fatalf("Message %d on %s is dropped", i, topic)
+			}
+		}
+	}
+	p.Stop()
+
+	for _, topic := range topics {
+		if len(processed[topic]) != 50 || !slices.IsSorted(processed[topic]) {
+			t.Errorf("Unexpected order of messages on %s: %v", topic, processed[topic])
+		}
+	}
+}
+
+func TestPipelineFullQueue(t *testing.T) {
+	metrics := NewMetrics(MetricsConfig{})
+	p := NewPipeline(PipelineConfig{Workers: 1, QueueSize: 2}, func(Message) {}, metrics)
+
+	// Workers are not started, so the queue is not consumed
+	for i := range 3 {
+		ok := p.Push(Message{Topic: "qingping/a/up", Payload: []byte(strconv.Itoa(i))})
+		if ok != (i < 2) {
+			t.Fatalf("Unexpected result of push %d: %v", i, ok)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.PipelineDroppedCounter); v != 1 {
+		t.Fatalf("Expected 1 dropped message, got %v", v)
+	}
+	if v := testutil.ToFloat64(metrics.PipelineQueueDepthGauge); v != 2 || p.Len() != 2 {
+		t.Fatalf("Expected queue depth 2, got %v (length %d)", v, p.Len())
+	}
+
+	p.Start()
+	p.Stop()
+	if v := testutil.ToFloat64(metrics.PipelineQueueDepthGauge); v != 0 || p.Len() != 0 {
+		t.Fatalf("Expected empty queue, got depth %v (length %d)", v, p.Len())
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	var mx sync.Mutex
+	var processed int
+	metrics := NewMetrics(MetricsConfig{})
+	p := NewPipeline(PipelineConfig{Workers: 2, QueueSize: 100}, func(Message) {
+		mx.Lock()
+		processed++
+		mx.Unlock()
+	}, metrics)
+
+	for i := range 100 {
+		p.Push(Message{Topic: fmt.Sprintf("qingping/%d/up", i%10)})
+	}
+	queued := p.Len()
+	p.Start()
+	p.Stop()
+
+	if processed != queued {
+		t.Fatalf("Expected %d processed messages, got %d", queued, processed)
+	}
+	if p.Push(Message{Topic: "qingping/a/up"}) {
+		t.Fatal("Message is accepted after stop")
+	}
+	if v := testutil.ToFloat64(metrics.PipelineDroppedCounter); v != float64(100-queued+1) {
+		t.Fatalf("Unexpected number of dropped messages: %v", v)
+	}
+}
@@ -0,0 +1,33 @@
+package qingping_test
+
+import (
+	"fmt"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+func Example() {
+	mux := qingping.NewMux()
+	mux.HandleFunc(qingping.RealTimeSensorDataType, func(_ string, msg qingping.Message) error {
+		for _, d := range msg.SensorData {
+			fmt.Println(msg.DeviceMAC(), d.Fields()["co2"])
+		}
+		return nil
+	})
+
+	p := &qingping.Processor{
+		Handler: mux,
+		// Publish with any MQTT client, e.g. client.Publish(topic, 0, false, payload)
+		Publish: func(topic string, _ []byte) error {
+			fmt.Println("ack to", topic)
+			return nil
+		},
+	}
+	payload := `{"type": "12", "id": 1, "need_ack": 1, "mac": "112233445566", "sensorData": [{"co2": {"value": 850}}]}`
+	if err := p.Process("qingping/office/up", []byte(payload)); err != nil {
+		fmt.Println(err)
+	}
+	// Output:
+	// 112233445566 850
+	// ack to qingping/office/down
+}
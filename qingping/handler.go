@@ -0,0 +1,92 @@
+package qingping
+
+import (
+	"fmt"
+	"time"
+)
+
+// Handler processes messages of devices. Topic is the topic the message
+// was published to.
+//
+// A message is acknowledged by Processor only if the handler returns
+// no error, so the device sends it again later.
+type Handler interface {
+	HandleMessage(topic string, msg Message) error
+}
+
+// HandlerFunc is an adapter to use functions as handlers.
+type HandlerFunc func(topic string, msg Message) error
+
+// HandleMessage calls f(topic, msg).
+func (f HandlerFunc) HandleMessage(topic string, msg Message) error {
+	return f(topic, msg)
+}
+
+// Mux routes messages to handlers by message type. Messages of types
+// without a handler are ignored. Handlers must be set before processing
+// messages.
+type Mux struct {
+	handlers map[string]Handler
+}
+
+// NewMux creates a new message router.
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]Handler)}
+}
+
+// Handle sets the handler of the message type.
+func (m *Mux) Handle(msgType string, h Handler) {
+	m.handlers[msgType] = h
+}
+
+// HandleFunc sets the handler function of the message type.
+func (m *Mux) HandleFunc(msgType string, f func(topic string, msg Message) error) {
+	m.handlers[msgType] = HandlerFunc(f)
+}
+
+// HandleMessage passes the message to the handler of its type.
+func (m *Mux) HandleMessage(topic string, msg Message) error {
+	h, ok := m.handlers[msg.Type]
+	if !ok {
+		return nil
+	}
+	return h.HandleMessage(topic, msg) //nolint:wrapcheck
+}
+
+// PublishFunc publishes the payload to the topic.
+type PublishFunc func(topic string, payload []byte) error
+
+// Processor decodes payloads of messages, passes them to the handler,
+// and sends acknowledgments to devices that require them.
+type Processor struct {
+	Handler Handler
+	Publish PublishFunc      // nil to not send acknowledgments
+	Now     func() time.Time // time of acknowledgments, time.Now by default
+}
+
+// Process handles the payload published to the topic.
+func (p *Processor) Process(topic string, payload []byte) error {
+	msg, err := Decode(payload)
+	if err != nil {
+		return err
+	}
+	if err := p.Handler.HandleMessage(topic, msg); err != nil {
+		return fmt.Errorf("handle message: %w", err)
+	}
+	if !msg.AckRequired() || p.Publish == nil {
+		return nil
+	}
+
+	now := time.Now
+	if p.Now != nil {
+		now = p.Now
+	}
+	data, err := Encode(Ack(msg.ID, now()))
+	if err != nil {
+		return err
+	}
+	if err := p.Publish(DownTopic(topic), data); err != nil {
+		return fmt.Errorf("publish acknowledgment: %w", err)
+	}
+	return nil
+}
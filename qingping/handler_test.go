@@ -0,0 +1,83 @@
+package qingping
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProcessor(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var handled []string
+	mux := NewMux()
+	mux.HandleFunc(RealTimeSensorDataType, func(topic string, msg Message) error {
+		handled = append(handled, topic+" "+msg.Type)
+		return nil
+	})
+	mux.HandleFunc(HistorySensorDataType, func(string, Message) error {
+		return errors.New("sink is down")
+	})
+
+	published := map[string]string{}
+	p := &Processor{
+		Handler: mux,
+		Publish: func(topic string, payload []byte) error {
+			published[topic] = string(payload)
+			return nil
+		},
+		Now: func() time.Time { return now },
+	}
+
+	t.Run("acknowledged", func(t *testing.T) {
+		err := p.Process("qingping/office/up", []byte(`{"type": "12", "id": 1, "need_ack": 1}`))
+		if err != nil {
+			t.Fatalf("Failed to process message: %v", err)
+		}
+		if len(handled) != 1 || handled[0] != "qingping/office/up 12" {
+			t.Fatalf("Unexpected handled messages: %v", handled)
+		}
+		expected := `{"type":"18","timestamp":1700000000,"ack_id":1,"code":0}`
+		if ack := published["qingping/office/down"]; ack != expected {
+			t.Fatalf("Unexpected acknowledgment: %s", ack)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		clear(published)
+		err := p.Process("qingping/office/up", []byte(`{"type": "17", "id": 2, "need_ack": 1}`))
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if len(published) != 0 {
+			t.Fatalf("Unexpected acknowledgment: %v", published)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		clear(published)
+		err := p.Process("qingping/office/up", []byte(`{"type": "13"}`))
+		if err != nil {
+			t.Fatalf("Failed to process message: %v", err)
+		}
+		if len(handled) != 1 || len(published) != 0 {
+			t.Fatalf("Unexpected processing: %v, %v", handled, published)
+		}
+	})
+
+	t.Run("invalid payload", func(t *testing.T) {
+		if err := p.Process("qingping/office/up", []byte(`not json`)); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+}
+
+func TestTimeSync(t *testing.T) {
+	data, err := Encode(TimeSync(time.Unix(1700000000, 0)))
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	expected := `{"type":"18","timestamp":1700000000,"ack_id":0,"code":0}`
+	if string(data) != expected {
+		t.Fatalf("Unexpected payload: %s", data)
+	}
+}
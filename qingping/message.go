@@ -0,0 +1,217 @@
+// Package qingping implements the JSON protocol of Qingping devices
+// that report to a self-hosted MQTT broker: decoding of messages sent
+// by devices, encoding of responses and commands sent to them, and
+// a handler API to process messages.
+//
+// Protocol description:
+// https://developer.qingping.co/private/communication-protocols/public-mqtt-json
+//
+// Decode parses sensor data and heartbeat messages into a single Message
+// struct. DecodeTyped parses every message type into its own struct,
+// keeping unknown fields at all levels, so it can be encoded back
+// with Encode.
+//
+// The package doesn't depend on any MQTT library. Payloads of messages
+// published by devices are passed to Decode or Processor, and encoded
+// responses are published with any client or broker.
+package qingping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// List of message types.
+const (
+	BLEConnectionRequestType        = "1"
+	BLEDisconnectionRequestType     = "2"
+	BLEOpenNotificationRequestType  = "3"
+	BLECloseNotificationRequestType = "4"
+	BLENotificationResponseType     = "5"
+	BLEDataWithResponseType         = "6"
+	BLEReadDataType                 = "7"
+	BLEDataResponseType             = "8"
+	BroadcastDataType               = "9"
+	DeviceListRequestType           = "10"
+	DeviceListResponseType          = "11"
+	RealTimeSensorDataType          = "12"
+	HeartbeatType                   = "13"
+	MQTTReconnectType               = "14"
+	BLEDataWithoutResponseType      = "15"
+	MQTTConnectionSettingType       = "16"
+	HistorySensorDataType           = "17"
+	HistoryDataResponseType         = "18"
+	DeviceLogReportType             = "19"
+	BindingStatusType               = "20"
+	OTACommandType                  = "23"
+	OTAResponseType                 = "24"
+	DeviceListWithNameRequestType   = "25"
+	DeviceListWithNameResponseType  = "26"
+	ThirdPartyBindingStatusType     = "27"
+	DeviceSettingReadRequestType    = "28"
+)
+
+// Message is the envelope of messages sent by devices. It covers sensor
+// data and heartbeat messages, see DecodeTyped for all message types.
+type Message struct {
+	ID         int          `json:"id"`
+	Type       string       `json:"type"`
+	NeedAck    int          `json:"need_ack"`
+	MAC        string       `json:"mac"`      // set in sensor data messages
+	WifiMAC    string       `json:"wifi_mac"` // set in heartbeat messages
+	Timestamp  int64        `json:"timestamp"`
+	SensorData []SensorData `json:"sensorData"`
+}
+
+// Decode parses the payload of a message sent by a device. Values of wrong
+// types are skipped: the message is returned with *ValidationError
+// of ReasonBadType.
+func Decode(payload []byte) (Message, error) {
+	var msg Message
+	_, err := decodeFields(payload, &msg)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return msg, fmt.Errorf("decode message: %w", &ValidationError{
+			Reason: ReasonBadType,
+			Field:  typeErr.Field,
+			Detail: "unexpected " + typeErr.Value,
+		})
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("decode message: %w", err)
+	}
+	return msg, nil
+}
+
+// DeviceMAC returns MAC address of the device. In different types
+// of messages it is set in different fields.
+func (m Message) DeviceMAC() string {
+	if m.WifiMAC != "" {
+		return m.WifiMAC
+	}
+	return m.MAC
+}
+
+// AckRequired reports whether the device waits for an acknowledgment
+// of the message, see Ack.
+func (m Message) AckRequired() bool {
+	return m.NeedAck == 1
+}
+
+// Time returns the device time when the message was sent. The second
+// value is false when the message has no timestamp.
+func (m Message) Time() (time.Time, bool) {
+	if m.Timestamp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(m.Timestamp, 0), true
+}
+
+// SensorData represents sensor readings in type "12" and "17" messages.
+type SensorData struct {
+	Timestamp   Value `json:"timestamp,omitzero"`
+	Temperature Value `json:"temperature,omitzero"`
+	Humidity    Value `json:"humidity,omitzero"`
+	CO2         Value `json:"co2,omitzero"`
+	PM1         Value `json:"pm1,omitzero"`
+	PM25        Value `json:"pm25,omitzero"`
+	PM10        Value `json:"pm10,omitzero"`
+	TVOC        Value `json:"tvoc,omitzero"`
+	Radon       Value `json:"radon,omitzero"`
+	Battery     Value `json:"battery,omitzero"`
+
+	// Extra contains sensors unknown to the struct, they are encoded
+	// back as is.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// sensorData has the fields of SensorData without its JSON methods.
+type sensorData SensorData
+
+// UnmarshalJSON decodes the data and keeps unknown sensors.
+func (d *SensorData) UnmarshalJSON(data []byte) error {
+	extra, err := decodeFields(data, (*sensorData)(d))
+	d.Extra = extra
+	return err
+}
+
+// MarshalJSON encodes the data with unknown sensors.
+func (d SensorData) MarshalJSON() ([]byte, error) {
+	return encodeFields((*sensorData)(&d), d.Extra)
+}
+
+// Fields returns values of all sensors present in the data, keyed by
+// sensor name (see SensorFields). Timestamp is not included.
+func (d SensorData) Fields() map[string]float64 {
+	values := []Value{
+		d.Temperature, d.Humidity, d.CO2, d.PM1, d.PM25,
+		d.PM10, d.TVOC, d.Radon, d.Battery,
+	}
+	fields := make(map[string]float64, len(values))
+	for i, v := range values {
+		if v.Valid {
+			fields[SensorFields[i]] = v.Value
+		}
+	}
+	return fields
+}
+
+// Time returns the device time of the sample. The second value is false
+// when the sample has no timestamp.
+func (d SensorData) Time() (time.Time, bool) {
+	if d.Timestamp.Value <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(d.Timestamp.Value), 0), true
+}
+
+// SensorFields is the list of sensor names in the order of SensorData fields.
+var SensorFields = []string{
+	"temperature", "humidity", "co2", "pm1", "pm25",
+	"pm10", "tvoc", "radon", "battery",
+}
+
+// Value is a sensor value. Devices send values as objects with optional
+// additional fields, such as status or level, they are kept in Extra.
+type Value struct {
+	Value float64 `json:"value"`
+	Valid bool    `json:"-"` // true if the value was present in the message
+
+	// Extra contains fields of the value object other than the value,
+	// they are encoded back as is.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// value is the JSON representation of Value.
+type value struct {
+	Value *float64 `json:"value,omitempty"`
+}
+
+// IsZero reports whether the value is absent, so it is omitted
+// on encoding.
+func (v Value) IsZero() bool {
+	return !v.Valid && len(v.Extra) == 0
+}
+
+// UnmarshalJSON decodes the value and marks it as present.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var raw value
+	extra, err := decodeFields(data, &raw)
+	if err == nil && raw.Value != nil {
+		v.Value = *raw.Value
+		v.Valid = true
+	}
+	v.Extra = extra
+	return err
+}
+
+// MarshalJSON encodes the value with its additional fields.
+func (v Value) MarshalJSON() ([]byte, error) {
+	var raw value
+	if v.Valid {
+		raw.Value = &v.Value
+	}
+	return encodeFields(&raw, v.Extra)
+}
@@ -0,0 +1,123 @@
+package qingping
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	payload := `{
+		"type": "17",
+		"id": 12345,
+		"need_ack": 1,
+		"mac": "112233445566",
+		"timestamp": 1594815555,
+		"sensorData": [{
+			"timestamp": {"value": 1592192453},
+			"temperature": {"value": 23.5, "status": 1},
+			"co2": {"value": 0}
+		}]
+	}`
+	msg, err := Decode([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+
+	if msg.Type != HistorySensorDataType || msg.ID != 12345 || !msg.AckRequired() {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	if mac := msg.DeviceMAC(); mac != "112233445566" {
+		t.Fatalf("Unexpected MAC: %s", mac)
+	}
+	if ts, ok := msg.Time(); !ok || !ts.Equal(time.Unix(1594815555, 0)) {
+		t.Fatalf("Unexpected time: %v", ts)
+	}
+	if len(msg.SensorData) != 1 {
+		t.Fatalf("Unexpected sensor data: %+v", msg.SensorData)
+	}
+	data := msg.SensorData[0]
+	if ts, ok := data.Time(); !ok || !ts.Equal(time.Unix(1592192453, 0)) {
+		t.Fatalf("Unexpected sample time: %v", ts)
+	}
+	expected := map[string]float64{"temperature": 23.5, "co2": 0}
+	if fields := data.Fields(); !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Unexpected fields: %v", fields)
+	}
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	msg, err := Decode([]byte(`{"type": "13", "wifi_mac": "AABBCCDDEEFF"}`))
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	if mac := msg.DeviceMAC(); mac != "AABBCCDDEEFF" {
+		t.Fatalf("Unexpected MAC: %s", mac)
+	}
+	if _, ok := msg.Time(); ok {
+		t.Fatal("Expected no time")
+	}
+	if msg.AckRequired() {
+		t.Fatal("Expected no ack required")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := Decode([]byte(`{"type": 17`)); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestDecodeBadType(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+		field   string
+	}{
+		{
+			name:    "mac",
+			payload: `{"type": "12", "mac": 123, "sensorData": [{"co2": {"value": 850}}]}`,
+			field:   "mac",
+		},
+		{
+			name: "sensor value",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [` +
+				`{"co2": {"value": 850}}, {"humidity": {"value": "x"}, "co2": {"value": 850}}]}`,
+			field: "sensorData[1].humidity.value",
+		},
+		{
+			name:    "sensor object",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [{"humidity": 5, "co2": {"value": 850}}]}`,
+			field:   "sensorData[0].humidity",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := Decode([]byte(tc.payload))
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected validation error, got %v", err)
+			}
+			if verr.Reason != ReasonBadType || verr.Field != tc.field {
+				t.Fatalf("Unexpected error: %v", verr)
+			}
+			// Other values are decoded
+			if msg.Type != "12" || len(msg.SensorData) == 0 {
+				t.Fatalf("Unexpected message: %+v", msg)
+			}
+			last := msg.SensorData[len(msg.SensorData)-1]
+			if last.CO2.Value != 850 || last.Humidity.Valid {
+				t.Fatalf("Unexpected sensor data: %+v", last)
+			}
+		})
+	}
+
+	t.Run("not an object", func(t *testing.T) {
+		_, err := Decode([]byte(`[]`))
+		var verr *ValidationError
+		if err == nil || errors.As(err, &verr) {
+			t.Fatalf("Expected parse error, got %v", err)
+		}
+	})
+}
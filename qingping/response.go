@@ -0,0 +1,27 @@
+package qingping
+
+import (
+	"strings"
+	"time"
+)
+
+// Ack returns the acknowledgment of the message with the ID. The same
+// type "18" message is used as an acknowledgment and as a time sync
+// command: devices set their clock from its timestamp.
+func Ack(id int, now time.Time) *HistoryDataResponse {
+	return &HistoryDataResponse{
+		Header: Header{Type: HistoryDataResponseType, Timestamp: now.Unix()},
+		AckID:  id,
+	}
+}
+
+// TimeSync returns the command that sets the device clock.
+func TimeSync(now time.Time) *HistoryDataResponse {
+	return Ack(0, now)
+}
+
+// DownTopic returns the topic the device listens to, by the topic it
+// publishes to, e.g. qingping/<name>/up gives qingping/<name>/down.
+func DownTopic(upTopic string) string {
+	return strings.Replace(upTopic, "/up", "/down", 1)
+}
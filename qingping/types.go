@@ -0,0 +1,493 @@
+package qingping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// TypedMessage is a message decoded into the struct of its type, see
+// DecodeTyped. Fields that are not described by the struct are kept
+// in Extra of its header.
+type TypedMessage interface {
+	MessageHeader() *Header
+}
+
+// Header contains fields common to all message types.
+type Header struct {
+	ID        int    `json:"id,omitempty"`
+	Type      string `json:"type"`
+	NeedAck   int    `json:"need_ack,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	// Extra contains top-level fields unknown to the message struct,
+	// they are encoded back as is.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// MessageHeader returns the header of the message.
+func (h *Header) MessageHeader() *Header {
+	return h
+}
+
+// BLEConnectionRequest asks the gateway to connect to a BLE device (type 1).
+type BLEConnectionRequest struct {
+	Header
+}
+
+// BLEDisconnectionRequest asks the gateway to disconnect from a BLE device
+// (type 2).
+type BLEDisconnectionRequest struct {
+	Header
+}
+
+// BLEOpenNotificationRequest enables notifications of a characteristic
+// of a BLE device (type 3).
+type BLEOpenNotificationRequest struct {
+	Header
+	Service        string `json:"service_uuid,omitempty"`
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+}
+
+// BLECloseNotificationRequest disables notifications of a characteristic
+// of a BLE device (type 4).
+type BLECloseNotificationRequest struct {
+	Header
+	Service        string `json:"service_uuid,omitempty"`
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+}
+
+// BLENotificationResponse is a notification from a BLE device (type 5).
+// Data is hex encoded.
+type BLENotificationResponse struct {
+	Header
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+	Data           string `json:"data,omitempty"`
+}
+
+// BLEDataWithResponse writes data to a characteristic of a BLE device and
+// waits for the response (type 6). Data is hex encoded.
+type BLEDataWithResponse struct {
+	Header
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+	Data           string `json:"data,omitempty"`
+}
+
+// BLEReadData reads a characteristic of a BLE device (type 7).
+type BLEReadData struct {
+	Header
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+}
+
+// BLEDataResponse is the result of reading or writing a characteristic
+// of a BLE device (type 8). Data is hex encoded.
+type BLEDataResponse struct {
+	Header
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+	Data           string `json:"data,omitempty"`
+	Code           int    `json:"code,omitempty"`
+}
+
+// BroadcastData is an advertisement packet of a BLE device received by
+// the gateway (type 9). Data is hex encoded.
+type BroadcastData struct {
+	Header
+	RSSI int    `json:"rssi,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// DeviceListRequest asks the gateway for the list of BLE devices
+// around (type 10).
+type DeviceListRequest struct {
+	Header
+}
+
+// DeviceListResponse is the list of BLE devices around the gateway
+// (type 11).
+type DeviceListResponse struct {
+	Header
+	Devices []DeviceEntry `json:"devices,omitempty"`
+}
+
+// DeviceEntry is a BLE device in device lists.
+type DeviceEntry struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name,omitempty"`
+	RSSI int    `json:"rssi,omitempty"`
+
+	// Extra contains fields unknown to the struct, they are encoded
+	// back as is.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// deviceEntry has the fields of DeviceEntry without its JSON methods.
+type deviceEntry DeviceEntry
+
+// UnmarshalJSON decodes the entry and keeps unknown fields.
+func (e *DeviceEntry) UnmarshalJSON(data []byte) error {
+	extra, err := decodeFields(data, (*deviceEntry)(e))
+	e.Extra = extra
+	return err
+}
+
+// MarshalJSON encodes the entry with its unknown fields.
+func (e DeviceEntry) MarshalJSON() ([]byte, error) {
+	return encodeFields((*deviceEntry)(&e), e.Extra)
+}
+
+// RealTimeSensorData contains current sensor readings (type 12).
+type RealTimeSensorData struct {
+	Header
+	SensorData []SensorData `json:"sensorData,omitempty"`
+}
+
+// Heartbeat is sent by devices periodically (type 13).
+type Heartbeat struct {
+	Header
+	WifiMAC string `json:"wifi_mac,omitempty"`
+}
+
+// MQTTReconnect makes the device reconnect to the broker (type 14).
+type MQTTReconnect struct {
+	Header
+}
+
+// BLEDataWithoutResponse writes data to a characteristic of a BLE device
+// without waiting for the response (type 15). Data is hex encoded.
+type BLEDataWithoutResponse struct {
+	Header
+	Characteristic string `json:"characteristic_uuid,omitempty"`
+	Data           string `json:"data,omitempty"`
+}
+
+// MQTTConnectionSetting changes broker settings of the device (type 16).
+type MQTTConnectionSetting struct {
+	Header
+	Host      string `json:"host,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	UpTopic   string `json:"up_topic,omitempty"`
+	DownTopic string `json:"down_topic,omitempty"`
+}
+
+// HistorySensorData contains readings stored by the device while
+// it was offline or between reports (type 17).
+type HistorySensorData struct {
+	Header
+	SensorData []SensorData `json:"sensorData,omitempty"`
+}
+
+// HistoryDataResponse acknowledges a message, and sets the device clock
+// from its timestamp (type 18). See Ack and TimeSync.
+type HistoryDataResponse struct {
+	Header
+	AckID int    `json:"ack_id"`
+	Code  int    `json:"code"`
+	Desc  string `json:"desc,omitempty"`
+}
+
+// DeviceLogReport contains log records of the device (type 19).
+type DeviceLogReport struct {
+	Header
+	Log string `json:"log,omitempty"`
+}
+
+// BindingStatus reports whether the device is bound to an account
+// (type 20).
+type BindingStatus struct {
+	Header
+	Status int `json:"status"`
+}
+
+// OTACommand asks the device to update firmware (type 23).
+type OTACommand struct {
+	Header
+	URL     string `json:"url,omitempty"`
+	Version string `json:"version,omitempty"`
+	MD5     string `json:"md5,omitempty"`
+}
+
+// OTAResponse is the result of firmware update (type 24).
+type OTAResponse struct {
+	Header
+	Code int    `json:"code"`
+	Desc string `json:"desc,omitempty"`
+}
+
+// DeviceListWithNameRequest asks the gateway for the list of BLE devices
+// around with their names (type 25).
+type DeviceListWithNameRequest struct {
+	Header
+}
+
+// DeviceListWithNameResponse is the list of BLE devices around
+// the gateway with their names (type 26).
+type DeviceListWithNameResponse struct {
+	Header
+	Devices []DeviceEntry `json:"devices,omitempty"`
+}
+
+// ThirdPartyBindingStatus reports whether the device is bound to
+// a third party platform (type 27).
+type ThirdPartyBindingStatus struct {
+	Header
+	Status int `json:"status"`
+}
+
+// DeviceSettingReadRequest asks the device for its settings, the device
+// responds with a message of the same type (type 28).
+type DeviceSettingReadRequest struct {
+	Header
+	Setting map[string]json.RawMessage `json:"setting,omitempty"`
+}
+
+// Unknown is a message of a type not described by the protocol.
+// All fields except the header are kept in Extra.
+type Unknown struct {
+	Header
+}
+
+// messageTypes maps message types to constructors of their structs.
+var messageTypes = map[string]func() TypedMessage{
+	BLEConnectionRequestType:        func() TypedMessage { return &BLEConnectionRequest{} },
+	BLEDisconnectionRequestType:     func() TypedMessage { return &BLEDisconnectionRequest{} },
+	BLEOpenNotificationRequestType:  func() TypedMessage { return &BLEOpenNotificationRequest{} },
+	BLECloseNotificationRequestType: func() TypedMessage { return &BLECloseNotificationRequest{} },
+	BLENotificationResponseType:     func() TypedMessage { return &BLENotificationResponse{} },
+	BLEDataWithResponseType:         func() TypedMessage { return &BLEDataWithResponse{} },
+	BLEReadDataType:                 func() TypedMessage { return &BLEReadData{} },
+	BLEDataResponseType:             func() TypedMessage { return &BLEDataResponse{} },
+	BroadcastDataType:               func() TypedMessage { return &BroadcastData{} },
+	DeviceListRequestType:           func() TypedMessage { return &DeviceListRequest{} },
+	DeviceListResponseType:          func() TypedMessage { return &DeviceListResponse{} },
+	RealTimeSensorDataType:          func() TypedMessage { return &RealTimeSensorData{} },
+	HeartbeatType:                   func() TypedMessage { return &Heartbeat{} },
+	MQTTReconnectType:               func() TypedMessage { return &MQTTReconnect{} },
+	BLEDataWithoutResponseType:      func() TypedMessage { return &BLEDataWithoutResponse{} },
+	MQTTConnectionSettingType:       func() TypedMessage { return &MQTTConnectionSetting{} },
+	HistorySensorDataType:           func() TypedMessage { return &HistorySensorData{} },
+	HistoryDataResponseType:         func() TypedMessage { return &HistoryDataResponse{} },
+	DeviceLogReportType:             func() TypedMessage { return &DeviceLogReport{} },
+	BindingStatusType:               func() TypedMessage { return &BindingStatus{} },
+	OTACommandType:                  func() TypedMessage { return &OTACommand{} },
+	OTAResponseType:                 func() TypedMessage { return &OTAResponse{} },
+	DeviceListWithNameRequestType:   func() TypedMessage { return &DeviceListWithNameRequest{} },
+	DeviceListWithNameResponseType:  func() TypedMessage { return &DeviceListWithNameResponse{} },
+	ThirdPartyBindingStatusType:     func() TypedMessage { return &ThirdPartyBindingStatus{} },
+	DeviceSettingReadRequestType:    func() TypedMessage { return &DeviceSettingReadRequest{} },
+}
+
+// DownlinkTypes is the list of types of messages sent to devices.
+var DownlinkTypes = []string{
+	BLEConnectionRequestType,
+	BLEDisconnectionRequestType,
+	BLEOpenNotificationRequestType,
+	BLECloseNotificationRequestType,
+	BLEDataWithResponseType,
+	BLEReadDataType,
+	DeviceListRequestType,
+	MQTTReconnectType,
+	BLEDataWithoutResponseType,
+	MQTTConnectionSettingType,
+	HistoryDataResponseType,
+	OTACommandType,
+	DeviceListWithNameRequestType,
+	DeviceSettingReadRequestType,
+}
+
+// NewTypedMessage returns an empty message struct of the type,
+// or Unknown if the type is not described by the protocol.
+func NewTypedMessage(msgType string) TypedMessage {
+	if fn, ok := messageTypes[msgType]; ok {
+		msg := fn()
+		msg.MessageHeader().Type = msgType
+		return msg
+	}
+	return &Unknown{Header: Header{Type: msgType}}
+}
+
+// DecodeTyped parses the payload into the struct of its message type.
+func DecodeTyped(payload []byte) (TypedMessage, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return nil, fmt.Errorf("decode message: %w", err)
+	}
+
+	msg := NewTypedMessage(envelope.Type)
+	extra, err := decodeFields(payload, msg)
+	if err != nil {
+		return nil, fmt.Errorf("decode message of type %s: %w", envelope.Type, err)
+	}
+	msg.MessageHeader().Extra = extra
+	return msg, nil
+}
+
+// Encode returns the payload of the message. Fields from Extra are added
+// unless the message struct has fields with the same names.
+func Encode(msg TypedMessage) ([]byte, error) {
+	data, err := encodeFields(msg, msg.MessageHeader().Extra)
+	if err != nil {
+		return nil, fmt.Errorf("encode message: %w", err)
+	}
+	return data, nil
+}
+
+// decodeFields parses the JSON object into the struct v points to,
+// and returns fields unknown to the struct. Fields are decoded one by one,
+// so a value of a wrong type doesn't stop decoding of other fields: the first
+// *json.UnmarshalTypeError is returned after all fields are decoded.
+func decodeFields(data []byte, v any) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	rv := reflect.ValueOf(v).Elem()
+	var typeErr error
+	for _, f := range structFields(rv.Type()) {
+		raw, ok := fields[f.name]
+		if !ok {
+			continue
+		}
+		delete(fields, f.name)
+		err := decodeValue(raw, rv.FieldByIndex(f.index).Addr())
+		if err == nil {
+			continue
+		}
+		if !isTypeError(err) {
+			return nil, err
+		}
+		if typeErr == nil {
+			typeErr = prefixField(err, f.name)
+		}
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	return fields, typeErr
+}
+
+// decodeValue parses the JSON value into the value ptr points to. Items
+// of slices are decoded one by one, see decodeFields.
+func decodeValue(data json.RawMessage, ptr reflect.Value) error {
+	t := ptr.Elem().Type()
+	if t.Kind() != reflect.Slice || t.Elem().Kind() == reflect.Uint8 {
+		return json.Unmarshal(data, ptr.Interface()) //nolint:wrapcheck
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if items == nil {
+		return nil
+	}
+	slice := reflect.MakeSlice(t, len(items), len(items))
+	var typeErr error
+	for i, item := range items {
+		err := decodeValue(item, slice.Index(i).Addr())
+		if err == nil {
+			continue
+		}
+		if !isTypeError(err) {
+			return err
+		}
+		if typeErr == nil {
+			typeErr = prefixField(err, fmt.Sprintf("[%d]", i))
+		}
+	}
+	ptr.Elem().Set(slice)
+	return typeErr
+}
+
+// isTypeError reports whether the error is caused by a JSON value
+// of a wrong type.
+func isTypeError(err error) bool {
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &typeErr)
+}
+
+// prefixField adds the path to the field of the type error, e.g. "co2"
+// to "value" gives "co2.value".
+func prefixField(err error, path string) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	e := *typeErr
+	switch {
+	case e.Field == "":
+		e.Field = path
+	case strings.HasPrefix(e.Field, "["):
+		e.Field = path + e.Field
+	default:
+		e.Field = path + "." + e.Field
+	}
+	return &e
+}
+
+// encodeFields encodes the struct v points to, and adds fields from extra
+// unless the struct has fields with the same names.
+func encodeFields(v any, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err //nolint:wrapcheck
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	known := structFields(reflect.TypeOf(v).Elem())
+	for name, raw := range extra {
+		if !slices.ContainsFunc(known, func(f structField) bool { return f.name == name }) {
+			fields[name] = raw
+		}
+	}
+	// Map keys are sorted by the encoder, so the output is stable
+	return json.Marshal(fields) //nolint:wrapcheck
+}
+
+// structField is a field of a struct in JSON.
+type structField struct {
+	name  string
+	index []int // see reflect.Value.FieldByIndex
+}
+
+// structFieldsCache contains fields by struct type.
+var structFieldsCache sync.Map
+
+// structFields returns JSON fields of the struct in the order of
+// declaration, including fields of embedded structs.
+func structFields(t reflect.Type) []structField {
+	if v, ok := structFieldsCache.Load(t); ok {
+		return v.([]structField)
+	}
+	var fields []structField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case tag == "-":
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			for _, sub := range structFields(f.Type) {
+				index := append([]int{i}, sub.index...)
+				fields = append(fields, structField{name: sub.name, index: index})
+			}
+		case tag != "":
+			fields = append(fields, structField{name: tag, index: []int{i}})
+		case f.IsExported():
+			fields = append(fields, structField{name: f.Name, index: []int{i}})
+		}
+	}
+	structFieldsCache.Store(t, fields)
+	return fields
+}
@@ -0,0 +1,190 @@
+package qingping
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeTyped(t *testing.T) {
+	for n := 1; n <= 28; n++ {
+		msgType := fmt.Sprint(n)
+		t.Run(msgType, func(t *testing.T) {
+			payload := fmt.Sprintf(`{"type": "%s", "id": 7, "mac": "112233445566"}`, msgType)
+			msg, err := DecodeTyped([]byte(payload))
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			h := msg.MessageHeader()
+			if h.Type != msgType || h.ID != 7 || h.MAC != "112233445566" {
+				t.Fatalf("Unexpected header: %+v", h)
+			}
+			_, known := messageTypes[msgType]
+			if _, unknown := msg.(*Unknown); known == unknown {
+				t.Fatalf("Unexpected struct %T", msg)
+			}
+		})
+	}
+}
+
+func TestDecodeTypedFields(t *testing.T) {
+	payload := `{
+		"type": "12",
+		"id": 1,
+		"mac": "112233445566",
+		"sensorData": [{"co2": {"value": 850}}],
+		"version": "1.2.3",
+		"extra": {"a": 1}
+	}`
+	msg, err := DecodeTyped([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	data, ok := msg.(*RealTimeSensorData)
+	if !ok {
+		t.Fatalf("Unexpected struct %T", msg)
+	}
+	if len(data.SensorData) != 1 || data.SensorData[0].CO2.Value != 850 {
+		t.Fatalf("Unexpected sensor data: %+v", data.SensorData)
+	}
+	expected := map[string]json.RawMessage{
+		"version": json.RawMessage(`"1.2.3"`),
+		"extra":   json.RawMessage(`{"a": 1}`),
+	}
+	if !reflect.DeepEqual(data.Extra, expected) {
+		t.Fatalf("Unexpected extra fields: %s", data.Extra)
+	}
+
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	want := `{"extra":{"a":1},"id":1,"mac":"112233445566",` +
+		`"sensorData":[{"co2":{"value":850}}],"type":"12","version":"1.2.3"}`
+	if string(encoded) != want {
+		t.Fatalf("Unexpected payload: %s", encoded)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	payloads := map[string]string{
+		BLEConnectionRequestType:    `{"type":"1","id":1,"mac":"112233445566"}`,
+		BLEDisconnectionRequestType: `{"type":"2","id":1,"mac":"112233445566"}`,
+		BLEOpenNotificationRequestType: `{"type":"3","id":1,"mac":"112233445566",` +
+			`"service_uuid":"fff0","characteristic_uuid":"fff1"}`,
+		BLECloseNotificationRequestType: `{"type":"4","id":1,"mac":"112233445566",` +
+			`"service_uuid":"fff0","characteristic_uuid":"fff1"}`,
+		BLEDataWithResponseType: `{"type":"6","id":1,"mac":"112233445566",` +
+			`"characteristic_uuid":"fff2","data":"0a0b"}`,
+		BLEReadDataType:       `{"type":"7","id":1,"mac":"112233445566","characteristic_uuid":"fff2"}`,
+		DeviceListRequestType: `{"type":"10","id":1}`,
+		MQTTReconnectType:     `{"type":"14","id":1}`,
+		BLEDataWithoutResponseType: `{"type":"15","id":1,"mac":"112233445566",` +
+			`"characteristic_uuid":"fff2","data":"0c"}`,
+		MQTTConnectionSettingType: `{"type":"16","id":1,"need_ack":1,"host":"broker","port":1883,` +
+			`"username":"device","password":"secret","client_id":"office",` +
+			`"up_topic":"qingping/office/up","down_topic":"qingping/office/down"}`,
+		HistoryDataResponseType: `{"type":"18","ack_id":5,"code":0,"timestamp":1700000000}`,
+		OTACommandType: `{"type":"23","id":1,"url":"https://example.com/fw.bin",` +
+			`"version":"4.2.0","md5":"abc"}`,
+		DeviceListWithNameRequestType: `{"type":"25","id":1}`,
+		DeviceSettingReadRequestType: `{"type":"28","id":1,"setting":{"report_interval":900},` +
+			`"reserved":true}`,
+	}
+	for _, msgType := range DownlinkTypes {
+		t.Run(msgType, func(t *testing.T) {
+			payload, ok := payloads[msgType]
+			if !ok {
+				t.Fatal("No test payload")
+			}
+			assertRoundTrip(t, payload)
+		})
+	}
+	if len(payloads) != len(DownlinkTypes) {
+		t.Fatal("Test payloads don't match downlink types")
+	}
+}
+
+func TestEncodeRoundTripNested(t *testing.T) {
+	payloads := map[string]string{
+		DeviceListResponseType: `{"type":"11","id":1,"devices":[` +
+			`{"mac":"112233445566","rssi":-60,"product_id":1201},` +
+			`{"mac":"665544332211","version":"1.0"}]}`,
+		RealTimeSensorDataType: `{"type":"12","id":1,"mac":"112233445566","sensorData":[` +
+			`{"timestamp":{"value":1700000000},"co2":{"value":850,"status":1},` +
+			`"pm25":{"value":12,"level":2},"noise":{"value":40}}]}`,
+		HistorySensorDataType: `{"type":"17","id":1,"mac":"112233445566","sensorData":[` +
+			`{"timestamp":{"value":1700000000},"temperature":{"value":21.5},"lux":{"value":300}},` +
+			`{"timestamp":{"value":1700000900},"battery":{"status":0}}]}`,
+		DeviceListWithNameResponseType: `{"type":"26","id":1,"devices":[` +
+			`{"mac":"112233445566","name":"office","rssi":-60,"product_id":1201}]}`,
+	}
+	for msgType, payload := range payloads {
+		t.Run(msgType, func(t *testing.T) {
+			assertRoundTrip(t, payload)
+		})
+	}
+}
+
+// assertRoundTrip checks that the payload is encoded back unchanged
+// after decoding.
+func assertRoundTrip(t *testing.T, payload string) {
+	t.Helper()
+	msg, err := DecodeTyped([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	var before, after map[string]any
+	json.Unmarshal([]byte(payload), &before)
+	json.Unmarshal(encoded, &after)
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("Payload changed:\n%s\n%s", payload, encoded)
+	}
+}
+
+func TestEncodeNew(t *testing.T) {
+	msg := NewTypedMessage(OTACommandType)
+	cmd, ok := msg.(*OTACommand)
+	if !ok {
+		t.Fatalf("Unexpected struct %T", msg)
+	}
+	cmd.ID = 3
+	cmd.URL = "https://example.com/fw.bin"
+	data, err := Encode(cmd)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if string(data) != `{"id":3,"type":"23","url":"https://example.com/fw.bin"}` {
+		t.Fatalf("Unexpected payload: %s", data)
+	}
+}
+
+func TestDecodeTypedUnknown(t *testing.T) {
+	msg, err := DecodeTyped([]byte(`{"type": "99", "id": 1, "foo": "bar"}`))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if _, ok := msg.(*Unknown); !ok {
+		t.Fatalf("Unexpected struct %T", msg)
+	}
+	data, err := Encode(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if string(data) != `{"foo":"bar","id":1,"type":"99"}` {
+		t.Fatalf("Unexpected payload: %s", data)
+	}
+}
+
+func TestDecodeTypedInvalid(t *testing.T) {
+	for _, payload := range []string{`{"type": 12}`, `{"type": "12", "sensorData": 1}`, `[]`} {
+		if _, err := DecodeTyped([]byte(payload)); err == nil {
+			t.Fatalf("Expected error for %s", payload)
+		}
+	}
+}
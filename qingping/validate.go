@@ -0,0 +1,129 @@
+package qingping
+
+import (
+	"fmt"
+	"math"
+)
+
+// Reasons of validation errors.
+const (
+	ReasonMissingMAC      = "missing_mac"
+	ReasonBadTimestamp    = "bad_timestamp"
+	ReasonValueOutOfRange = "value_out_of_range"
+	ReasonUnknownType     = "unknown_type"
+	ReasonBadType         = "bad_type" // value of a wrong JSON type, see Decode
+)
+
+// ValidationError describes why the message is invalid.
+type ValidationError struct {
+	Reason string // one of Reason* constants
+	Field  string // name of the invalid field, if any
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Reason, e.Field, e.Detail)
+}
+
+// Range is the range of valid sensor values, inclusive.
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// SensorRanges maps sensor names (see SensorFields) to ranges of values
+// that devices can measure. Values outside are sensor faults.
+var SensorRanges = map[string]Range{
+	"temperature": {Min: -40, Max: 125},
+	"humidity":    {Min: 0, Max: 100},
+	"co2":         {Min: 0, Max: 10000},
+	"pm1":         {Min: 0, Max: 1000},
+	"pm25":        {Min: 0, Max: 1000},
+	"pm10":        {Min: 0, Max: 1000},
+	"tvoc":        {Min: 0, Max: 10000},
+	"radon":       {Min: 0, Max: 100000},
+	"battery":     {Min: 0, Max: 100},
+}
+
+// validators maps message types to their checks. Types without
+// a validator are checked only for being known.
+var validators = map[string]func(msg Message) error{
+	RealTimeSensorDataType: func(msg Message) error { return validateSensorData(msg, false) },
+	HistorySensorDataType:  func(msg Message) error { return validateSensorData(msg, true) },
+	HeartbeatType:          validateHeartbeat,
+}
+
+// Validate checks the message against the schema of its type. The error
+// is *ValidationError with the reason of the first found problem.
+func Validate(msg Message) error {
+	if _, ok := messageTypes[msg.Type]; !ok {
+		return &ValidationError{
+			Reason: ReasonUnknownType,
+			Field:  "type",
+			Detail: fmt.Sprintf("unknown type '%s'", msg.Type),
+		}
+	}
+	if msg.Timestamp < 0 {
+		return &ValidationError{
+			Reason: ReasonBadTimestamp,
+			Field:  "timestamp",
+			Detail: fmt.Sprintf("negative timestamp %d", msg.Timestamp),
+		}
+	}
+	if validate, ok := validators[msg.Type]; ok {
+		return validate(msg)
+	}
+	return nil
+}
+
+func validateHeartbeat(msg Message) error {
+	if msg.DeviceMAC() == "" {
+		return &ValidationError{Reason: ReasonMissingMAC, Field: "wifi_mac", Detail: "empty MAC"}
+	}
+	return nil
+}
+
+// validateSensorData checks sensor data messages. Samples of history
+// messages must have timestamps.
+func validateSensorData(msg Message, history bool) error {
+	if msg.DeviceMAC() == "" {
+		return &ValidationError{Reason: ReasonMissingMAC, Field: "mac", Detail: "empty MAC"}
+	}
+	for i, d := range msg.SensorData {
+		if err := validateSampleTime(d.Timestamp, history); err != nil {
+			err.Field = fmt.Sprintf("sensorData[%d].timestamp", i)
+			return err
+		}
+		for name, v := range d.Fields() {
+			r := SensorRanges[name]
+			if math.IsNaN(v) || v < r.Min || v > r.Max {
+				return &ValidationError{
+					Reason: ReasonValueOutOfRange,
+					Field:  fmt.Sprintf("sensorData[%d].%s", i, name),
+					Detail: fmt.Sprintf("value %v is out of range [%v, %v]", v, r.Min, r.Max),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateSampleTime checks that the timestamp is unix seconds. Zero
+// timestamp means the sample was taken right now.
+func validateSampleTime(ts Value, required bool) *ValidationError {
+	switch {
+	case (!ts.Valid || ts.Value == 0) && required:
+		return &ValidationError{Reason: ReasonBadTimestamp, Detail: "missing timestamp"}
+	case !ts.Valid:
+		return nil
+	case ts.Value < 0 || ts.Value > math.MaxInt64 || ts.Value != math.Trunc(ts.Value):
+		return &ValidationError{
+			Reason: ReasonBadTimestamp,
+			Detail: fmt.Sprintf("timestamp %v is not unix seconds", ts.Value),
+		}
+	}
+	return nil
+}
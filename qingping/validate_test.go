@@ -0,0 +1,94 @@
+package qingping
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+		reason  string
+	}{
+		{
+			name:    "valid real-time data",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [{"co2": {"value": 850}}]}`,
+		},
+		{
+			name:    "valid history data",
+			payload: `{"type": "17", "mac": "112233445566", "sensorData": [{"timestamp": {"value": 1700000000}}]}`,
+		},
+		{
+			name:    "valid heartbeat",
+			payload: `{"type": "13", "wifi_mac": "112233445566"}`,
+		},
+		{
+			name:    "other known type",
+			payload: `{"type": "19"}`,
+		},
+		{
+			name:    "unknown type",
+			payload: `{"type": "99", "mac": "112233445566"}`,
+			reason:  ReasonUnknownType,
+		},
+		{
+			name:    "missing mac",
+			payload: `{"type": "17", "sensorData": [{"timestamp": {"value": 1700000000}}]}`,
+			reason:  ReasonMissingMAC,
+		},
+		{
+			name:    "heartbeat without mac",
+			payload: `{"type": "13"}`,
+			reason:  ReasonMissingMAC,
+		},
+		{
+			name:    "negative message timestamp",
+			payload: `{"type": "12", "mac": "112233445566", "timestamp": -1}`,
+			reason:  ReasonBadTimestamp,
+		},
+		{
+			name:    "fractional sample timestamp",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [{"timestamp": {"value": 1.5}}]}`,
+			reason:  ReasonBadTimestamp,
+		},
+		{
+			name:    "history sample without timestamp",
+			payload: `{"type": "17", "mac": "112233445566", "sensorData": [{"co2": {"value": 850}}]}`,
+			reason:  ReasonBadTimestamp,
+		},
+		{
+			name:    "humidity out of range",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [{"humidity": {"value": 140}}]}`,
+			reason:  ReasonValueOutOfRange,
+		},
+		{
+			name:    "negative co2",
+			payload: `{"type": "12", "mac": "112233445566", "sensorData": [{"co2": {"value": -5}}]}`,
+			reason:  ReasonValueOutOfRange,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := Decode([]byte(tc.payload))
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			err = Validate(msg)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected validation error, got %v", err)
+			}
+			if verr.Reason != tc.reason {
+				t.Fatalf("Expected reason %s, got %s", tc.reason, verr.Reason)
+			}
+		})
+	}
+}
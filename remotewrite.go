@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteTimeout is the timeout of a single remote write request.
+const remoteWriteTimeout = 10 * time.Second
+
+// remoteWriteMetrics maps sensor names to the names of exported series.
+// Names are the same as names of gauges on /metrics.
+var remoteWriteMetrics = map[string]string{
+	"temperature": "qingping_temperature_celsius",
+	"humidity":    "qingping_humidity_percent",
+	"co2":         "qingping_co2_ppm",
+	"pm1":         "qingping_pm1_ugm3",
+	"pm25":        "qingping_pm25_ugm3",
+	"pm10":        "qingping_pm10_ugm3",
+	"tvoc":        "qingping_tvoc_ppb",
+	"radon":       "qingping_radon_bqm3",
+	"battery":     "qingping_battery_percent",
+
+	"temperature_fahrenheit": "qingping_temperature_fahrenheit",
+	"tvoc_ugm3":              "qingping_tvoc_ugm3",
+	"radon_pcil":             "qingping_radon_pcil",
+}
+
+// RemoteWriter is a sink that pushes readings to a Prometheus remote write
+// endpoint.
+type RemoteWriter struct {
+	url    string
+	client *http.Client
+}
+
+// NewRemoteWriter creates a new remote write client.
+func NewRemoteWriter(url string) *RemoteWriter {
+	return &RemoteWriter{
+		url:    url,
+		client: &http.Client{Timeout: remoteWriteTimeout},
+	}
+}
+
+// Write sends readings to the remote write endpoint.
+func (w *RemoteWriter) Write(readings []Reading) error {
+	return w.send(snappy.Encode(nil, encodeWriteRequest(readings)))
+}
+
+func (w *RemoteWriter) send(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteWriteTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: send request: %w", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status %d", errRetryable, resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes readings as a remote write protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// Samples of each series are sorted by time, as required by Prometheus.
+func encodeWriteRequest(readings []Reading) []byte {
+	type seriesKey struct{ name, mac string }
+	type point struct {
+		value float64
+		ts    int64
+	}
+	series := map[seriesKey][]point{}
+	for _, r := range readings {
+		for field, value := range r.Fields {
+			name, ok := remoteWriteMetrics[field]
+			if !ok {
+				continue
+			}
+			key := seriesKey{name: name, mac: r.MAC}
+			series[key] = append(series[key], point{value: value, ts: r.Time.UnixMilli()})
+		}
+	}
+
+	var req []byte
+	for key, points := range series {
+		slices.SortFunc(points, func(a, b point) int { return cmp.Compare(a.ts, b.ts) })
+
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, encodeLabel("__name__", key.name))
+		ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, encodeLabel("mac", key.mac))
+		for _, p := range points {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(p.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(p.ts)) //nolint:gosec
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+func encodeLabel(name, value string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, value)
+	return b
+}
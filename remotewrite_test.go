@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRemoteWriter(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+
+	SinkBackoff = time.Millisecond
+
+	var (
+		mx       sync.Mutex
+		requests int
+		body     []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Unexpected content encoding: %s", r.Header.Get("Content-Encoding"))
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		var err error
+		body, err = snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := newAsyncSink("remote_write", NewRemoteWriter(srv.URL), BatchConfig{
+		BatchSize:     2,
+		QueueSize:     10,
+		FlushInterval: time.Hour,
+	}, NewMetrics(MetricsConfig{}), log)
+	w.Start()
+
+	// Readings come in reverse order, as they can in history messages
+	w.Write(
+		Reading{MAC: "112233445566", Time: time.Unix(1592192460, 0), Fields: map[string]float64{"co2": 860}},
+		Reading{MAC: "112233445566", Time: time.Unix(1592192400, 0), Fields: map[string]float64{"co2": 850}},
+	)
+	if err := w.Stop(); err != nil {
+		t.Fatalf("Failed to stop sink: %v", err)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	if requests != 2 {
+		t.Fatalf("Expected 2 requests, got %d", requests)
+	}
+
+	series := decodeWriteRequest(t, body)
+	if len(series) != 1 {
+		t.Fatalf("Expected 1 series, got %d", len(series))
+	}
+	ts := series[0]
+	if ts.labels["__name__"] != "qingping_co2_ppm" || ts.labels["mac"] != "112233445566" {
+		t.Fatalf("Unexpected labels: %v", ts.labels)
+	}
+	expected := []int64{1592192400000, 1592192460000}
+	if len(ts.timestamps) != 2 || ts.timestamps[0] != expected[0] || ts.timestamps[1] != expected[1] {
+		t.Fatalf("Unexpected timestamps: %v", ts.timestamps)
+	}
+}
+
+type testSeries struct {
+	labels     map[string]string
+	timestamps []int64
+}
+
+// decodeWriteRequest decodes labels and sample timestamps from
+// a remote write request.
+func decodeWriteRequest(t *testing.T, b []byte) []testSeries {
+	t.Helper()
+
+	var result []testSeries
+	for _, ts := range decodeMessage(t, b)[1] {
+		series := testSeries{labels: map[string]string{}}
+		fields := decodeMessage(t, ts)
+		for _, label := range fields[1] {
+			lf := decodeMessage(t, label)
+			series.labels[string(lf[1][0])] = string(lf[2][0])
+		}
+		for _, sample := range fields[2] {
+			sf := decodeMessage(t, sample)
+			v, _ := protowire.ConsumeVarint(sf[2][0])
+			series.timestamps = append(series.timestamps, int64(v))
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+// decodeMessage splits protobuf message into raw field values by number.
+func decodeMessage(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	t.Helper()
+
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("Invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			value = b[:n]
+		}
+		if n < 0 {
+			t.Fatalf("Invalid value: %v", protowire.ParseError(n))
+		}
+		fields[num] = append(fields[num], value)
+		b = b[n:]
+	}
+	return fields
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RepublishSink is a sink that publishes readings back to the MQTT broker
+// as JSON, one topic per device, e.g. qingping/readings/112233445566.
+// This allows consumers to subscribe to parsed data instead of raw
+// device messages.
+type RepublishSink struct {
+	topic   string
+	publish PublishFunc
+}
+
+// NewRepublishSink creates a new republishing sink. MAC address of
+// the device is appended to the topic prefix.
+func NewRepublishSink(topic string, publish PublishFunc) *RepublishSink {
+	return &RepublishSink{
+		topic:   strings.TrimSuffix(topic, "/"),
+		publish: publish,
+	}
+}
+
+// Write publishes readings.
+func (s *RepublishSink) Write(readings []Reading) error {
+	for _, r := range readings {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshal reading: %w", err)
+		}
+		if err := s.publish(s.topic+"/"+r.MAC, payload, false, 0); err != nil {
+			return fmt.Errorf("publish reading: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Retry settings for writing to sinks.
+const sinkRetries = 5
+
+// SinkBackoff is the delay before the first retry of a failed write.
+// The delay doubles with every next retry.
+var SinkBackoff = 500 * time.Millisecond
+
+// errRetryable marks errors after which writing can be repeated.
+var errRetryable = errors.New("retryable error")
+
+// Reading is a normalised sensor sample of a device.
+type Reading struct {
+	MAC    string             `json:"mac"`
+	Time   time.Time          `json:"time"` // device timestamp
+	Fields map[string]float64 `json:"fields"`
+	Device Device             `json:"device"`
+
+	// Derived contains metrics computed from values in native units,
+	// see Derive. It is set before conversion to units of sinks.
+	Derived map[string]float64 `json:"-"`
+}
+
+// Sink is a destination of readings. Write is called from a single
+// goroutine, so implementations don't need to be thread-safe. Errors
+// wrapping errRetryable make the readings to be written again.
+type Sink interface {
+	Write(readings []Reading) error
+}
+
+// SinkEnv contains application components available to sinks.
+type SinkEnv struct {
+	History *History
+	Publish PublishFunc
+	Metrics *Metrics
+	Log     *logrus.Logger
+}
+
+// SinkFactory creates a sink and returns it with its batching settings.
+type SinkFactory func(conf Config, env SinkEnv) (Sink, BatchConfig, error)
+
+// SinkRegistry maps sink names to their factories.
+var SinkRegistry = map[string]SinkFactory{
+	"prometheus": func(_ Config, env SinkEnv) (Sink, BatchConfig, error) {
+		return NewPrometheusSink(env.Metrics), RealtimeBatchConfig, nil
+	},
+	"history": func(_ Config, env SinkEnv) (Sink, BatchConfig, error) {
+		return HistorySink{History: env.History}, RealtimeBatchConfig, nil
+	},
+	"mqtt": func(conf Config, env SinkEnv) (Sink, BatchConfig, error) {
+		if conf.Outputs.MQTT.Topic == "" {
+			return nil, BatchConfig{}, errors.New("empty republish topic")
+		}
+		return NewRepublishSink(conf.Outputs.MQTT.Topic, env.Publish), RealtimeBatchConfig, nil
+	},
+	"file": func(conf Config, _ SinkEnv) (Sink, BatchConfig, error) {
+		sink, err := NewFileSink(conf.Outputs.File.Path)
+		return sink, RealtimeBatchConfig, err
+	},
+	"remote_write": func(conf Config, _ SinkEnv) (Sink, BatchConfig, error) {
+		if conf.Outputs.RemoteWrite.URL == "" {
+			return nil, BatchConfig{}, errors.New("empty remote write URL")
+		}
+		return NewRemoteWriter(conf.Outputs.RemoteWrite.URL), conf.Outputs.RemoteWrite.BatchConfig, nil
+	},
+	"influxdb": func(conf Config, _ SinkEnv) (Sink, BatchConfig, error) {
+		if conf.Outputs.InfluxDB.URL == "" {
+			return nil, BatchConfig{}, errors.New("empty InfluxDB URL")
+		}
+		return NewInfluxWriter(conf.Outputs.InfluxDB), conf.Outputs.InfluxDB.BatchConfig, nil
+	},
+}
+
+// Sinks dispatches readings to all enabled sinks. Every sink has its own
+// queue and goroutine, so a slow sink doesn't block others.
+type Sinks struct {
+	list    []*asyncSink
+	devices Devices
+	mx      sync.RWMutex
+}
+
+// NewSinks creates sinks by their names using the registry.
+func NewSinks(conf Config, env SinkEnv) (*Sinks, error) {
+	sinks := &Sinks{devices: conf.Devices}
+	for _, name := range conf.Outputs.Sinks {
+		factory, ok := SinkRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sink '%s'", name)
+		}
+		sink, batch, err := factory(conf, env)
+		if err != nil {
+			return nil, fmt.Errorf("create sink '%s': %w", name, err)
+		}
+		async := newAsyncSink(name, sink, batch, env.Metrics, env.Log)
+		async.units = conf.Outputs.Units[name]
+		sinks.list = append(sinks.list, async)
+	}
+	return sinks, nil
+}
+
+// Write adds device metadata and derived metrics to readings, converts
+// values to units of every sink and puts them to queues of all sinks.
+func (s *Sinks) Write(readings ...Reading) {
+	s.mx.RLock()
+	for i := range readings {
+		readings[i].Device = s.devices.Get(readings[i].MAC)
+		readings[i].Derived = Derive(readings[i].Fields)
+	}
+	s.mx.RUnlock()
+	for _, sink := range s.list {
+		sink.Write(ConvertUnits(readings, sink.units)...)
+	}
+}
+
+// SetDevices replaces the registry of known devices.
+func (s *Sinks) SetDevices(devices Devices) {
+	s.mx.Lock()
+	s.devices = devices
+	s.mx.Unlock()
+}
+
+// Start starts background loops of all sinks. They run until Stop
+// is called, so readings queued on shutdown are still written.
+func (s *Sinks) Start() {
+	for _, sink := range s.list {
+		sink.Start()
+	}
+}
+
+// Stop stops all sinks and waits for their queues to be written.
+func (s *Sinks) Stop() error {
+	var errs []error
+	for _, sink := range s.list {
+		if err := sink.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("stop sink '%s': %w", sink.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SinkStatus describes recent writes of a sink.
+type SinkStatus struct {
+	Name      string  `json:"name"`
+	Batches   int     `json:"batches"`    // number of recent batches
+	ErrorRate float64 `json:"error_rate"` // share of failed recent batches
+	LastError string  `json:"last_error,omitempty"`
+	QueueLen  int     `json:"queue_len"`
+}
+
+// Status returns statuses of all sinks.
+func (s *Sinks) Status() []SinkStatus {
+	list := make([]SinkStatus, 0, len(s.list))
+	for _, sink := range s.list {
+		list = append(list, sink.Status())
+	}
+	return list
+}
+
+// sinkStatusWindow is the number of recent batches used to calculate
+// error rate of a sink.
+const sinkStatusWindow = 20
+
+// asyncSink queues readings in memory and writes them to the sink
+// in batches by a background loop.
+type asyncSink struct {
+	name    string
+	sink    Sink
+	conf    BatchConfig
+	units   UnitsConfig
+	queue   chan Reading
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	metrics *Metrics
+	log     *logrus.Entry
+
+	// Outcomes of recent batches, true for failed ones
+	results []bool
+	lastErr error
+	mx      sync.Mutex
+}
+
+func newAsyncSink(name string, sink Sink, conf BatchConfig, metrics *Metrics, log *logrus.Logger) *asyncSink {
+	return &asyncSink{
+		name:    name,
+		sink:    sink,
+		conf:    conf,
+		queue:   make(chan Reading, conf.QueueSize),
+		done:    make(chan struct{}),
+		metrics: metrics,
+		log:     log.WithField("sink", name),
+	}
+}
+
+// Write puts readings to the queue. Readings are dropped if the queue is full.
+func (s *asyncSink) Write(readings ...Reading) {
+	for _, r := range readings {
+		select {
+		case s.queue <- r:
+		default:
+			s.metrics.SinkDroppedCounter.WithLabelValues(s.name).Inc()
+		}
+	}
+}
+
+// Status returns the status of recent writes.
+func (s *asyncSink) Status() SinkStatus {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	status := SinkStatus{
+		Name:     s.name,
+		Batches:  len(s.results),
+		QueueLen: len(s.queue),
+	}
+	var failed int
+	for _, f := range s.results {
+		if f {
+			failed++
+		}
+	}
+	if len(s.results) > 0 {
+		status.ErrorRate = float64(failed) / float64(len(s.results))
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
+
+// record remembers the outcome of a batch.
+func (s *asyncSink) record(err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(s.results) == sinkStatusWindow {
+		s.results = s.results[1:]
+	}
+	s.results = append(s.results, err != nil)
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+// Start starts the background loop that writes queued readings until
+// Stop is called.
+func (s *asyncSink) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.loop()
+	}()
+}
+
+// Stop stops the writing loop, waits for the queue to be written and
+// closes the sink if it needs closing.
+func (s *asyncSink) Stop() error {
+	s.once.Do(func() { close(s.done) })
+	s.wg.Wait()
+	if c, ok := s.sink.(interface{ Close() error }); ok {
+		return c.Close() //nolint:wrapcheck
+	}
+	return nil
+}
+
+// loop writes queued readings in batches. Remaining readings are written
+// before exit. With zero flush interval readings are written as soon as
+// the queue is empty.
+func (s *asyncSink) loop() {
+	var tick <-chan time.Time
+	if s.conf.FlushInterval > 0 {
+		ticker := time.NewTicker(s.conf.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([]Reading, 0, s.conf.BatchSize)
+	for {
+		select {
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= s.conf.BatchSize || (tick == nil && len(s.queue) == 0) {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-tick:
+			s.flush(batch)
+			batch = batch[:0]
+		case <-s.done:
+			s.drain(batch)
+			return
+		}
+	}
+}
+
+// drain writes the batch and everything left in the queue.
+func (s *asyncSink) drain(batch []Reading) {
+	for {
+		select {
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= s.conf.BatchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		default:
+			s.flush(batch)
+			return
+		}
+	}
+}
+
+// flush writes the batch retrying on retryable errors.
+func (s *asyncSink) flush(batch []Reading) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	backoff := SinkBackoff
+	for attempt := range sinkRetries {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = s.sink.Write(batch)
+		if !errors.Is(err, errRetryable) {
+			break
+		}
+		s.log.WithError(err).Debug("Retrying to write readings")
+	}
+	s.record(err)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to write readings")
+		s.metrics.SinkErrorsCounter.WithLabelValues(s.name).Inc()
+		s.metrics.SinkFailedCounter.WithLabelValues(s.name).Add(float64(len(batch)))
+		return
+	}
+	s.metrics.SinkWrittenCounter.WithLabelValues(s.name).Add(float64(len(batch)))
+}
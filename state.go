@@ -0,0 +1,175 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceState is the current state of a device.
+type DeviceState struct {
+	MAC        string                   `json:"mac"`
+	Name       string                   `json:"name,omitempty"`
+	Model      string                   `json:"model,omitempty"`
+	Online     bool                     `json:"online"`
+	LastSeen   time.Time                `json:"last_seen,omitzero"`
+	ClientID   string                   `json:"client_id,omitempty"`
+	RemoteAddr string                   `json:"remote_addr,omitempty"`
+	Messages   map[string]int           `json:"messages"` // number of messages by type
+	Readings   map[string]LatestReading `json:"readings"` // latest values by sensor name
+}
+
+// LatestReading is the latest value of a sensor.
+type LatestReading struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"` // device timestamp
+}
+
+// DeviceStates is a cache of current states of devices. It is updated
+// by the broker on every message, and by the application on every reading.
+type DeviceStates struct {
+	states  map[string]*DeviceState
+	devices Devices
+	mx      sync.RWMutex
+}
+
+// NewDeviceStates creates a new cache. Devices from the registry are
+// listed even before they send anything.
+func NewDeviceStates(devices Devices) *DeviceStates {
+	return &DeviceStates{
+		states:  make(map[string]*DeviceState),
+		devices: devices,
+	}
+}
+
+// SetDevices replaces the registry of known devices.
+func (s *DeviceStates) SetDevices(devices Devices) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.devices = devices
+}
+
+// Received counts the message and remembers the connection it came from.
+func (s *DeviceStates) Received(mac, msgType, clientID, remoteAddr string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	state := s.state(mac)
+	state.Messages[msgType]++
+	state.ClientID = clientID
+	state.RemoteAddr = remoteAddr
+}
+
+// Alive marks the device as online.
+func (s *DeviceStates) Alive(mac string, t time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	state := s.state(mac)
+	state.Online = true
+	state.LastSeen = t
+}
+
+// Offline marks the device as offline.
+func (s *DeviceStates) Offline(mac string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.state(mac).Online = false
+}
+
+// Update remembers the latest values of sensors. Values older than
+// the current ones are skipped.
+func (s *DeviceStates) Update(readings []Reading) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, r := range readings {
+		state := s.state(r.MAC)
+		for field, value := range r.Fields {
+			if r.Time.Before(state.Readings[field].Time) {
+				continue
+			}
+			state.Readings[field] = LatestReading{Value: value, Time: r.Time}
+		}
+	}
+}
+
+// Get returns the state of the device. Known devices that haven't sent
+// anything yet are offline.
+func (s *DeviceStates) Get(mac string) (DeviceState, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	state, ok := s.states[mac]
+	if !ok {
+		if _, known := s.devices[mac]; !known {
+			return DeviceState{}, false
+		}
+		state = newDeviceState(mac)
+	}
+	return s.copy(state), true
+}
+
+// List returns states of all known and seen devices sorted by MAC.
+func (s *DeviceStates) List() []DeviceState {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	list := make([]DeviceState, 0, len(s.states))
+	for _, state := range s.states {
+		list = append(list, s.copy(state))
+	}
+	for mac := range s.devices {
+		if _, ok := s.states[mac]; !ok {
+			list = append(list, s.copy(newDeviceState(mac)))
+		}
+	}
+	slices.SortFunc(list, func(a, b DeviceState) int {
+		return strings.Compare(a.MAC, b.MAC)
+	})
+	return list
+}
+
+// LastSeen returns time of the last message of every device seen
+// since start, including offline ones.
+func (s *DeviceStates) LastSeen() map[string]time.Time {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	seen := make(map[string]time.Time, len(s.states))
+	for mac, state := range s.states {
+		if !state.LastSeen.IsZero() {
+			seen[mac] = state.LastSeen
+		}
+	}
+	return seen
+}
+
+// state returns the state of the device creating it if needed.
+// Must be called under the write lock.
+func (s *DeviceStates) state(mac string) *DeviceState {
+	state, ok := s.states[mac]
+	if !ok {
+		state = newDeviceState(mac)
+		s.states[mac] = state
+	}
+	return state
+}
+
+// copy returns a deep copy of the state with device description.
+func (s *DeviceStates) copy(state *DeviceState) DeviceState {
+	c := *state
+	c.Messages = maps.Clone(state.Messages)
+	c.Readings = maps.Clone(state.Readings)
+	dev := s.devices.Get(state.MAC)
+	c.Name = dev.Name
+	c.Model = dev.Model
+	return c
+}
+
+func newDeviceState(mac string) *DeviceState {
+	return &DeviceState{
+		MAC:      mac,
+		Messages: map[string]int{},
+		Readings: map[string]LatestReading{},
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/tetafro/qingping-mqtt/qingping"
+)
+
+// Units of sensor values. Devices report values in native units: Celsius,
+// ppb for TVOC, Bq/m³ for radon.
+const (
+	UnitCelsius    = "celsius"
+	UnitFahrenheit = "fahrenheit"
+	UnitPPB        = "ppb"
+	UnitUGM3       = "ugm3"
+	UnitBQM3       = "bqm3"
+	UnitPCIL       = "pcil"
+)
+
+// unitConversions maps sensor names to functions converting their values
+// from the native unit to other units.
+var unitConversions = map[string]map[string]func(float64) float64{
+	"temperature": {
+		UnitCelsius:    func(v float64) float64 { return v },
+		UnitFahrenheit: func(v float64) float64 { return v*9/5 + 32 },
+	},
+	"tvoc": {
+		UnitPPB: func(v float64) float64 { return v },
+		// Approximation for a typical VOC mixture with molar mass
+		// of 110 g/mol at 25 °C
+		UnitUGM3: func(v float64) float64 { return v * 4.5 },
+	},
+	"radon": {
+		UnitBQM3: func(v float64) float64 { return v },
+		UnitPCIL: func(v float64) float64 { return v / 37 },
+	},
+}
+
+// nativeUnits maps sensor names to units reported by devices.
+var nativeUnits = map[string]string{
+	"temperature": UnitCelsius,
+	"tvoc":        UnitPPB,
+	"radon":       UnitBQM3,
+}
+
+// list returns selected units by sensor name.
+func (c UnitsConfig) list() map[string][]string {
+	return map[string][]string{
+		"temperature": c.Temperature,
+		"tvoc":        c.TVOC,
+		"radon":       c.Radon,
+	}
+}
+
+// Fields returns names of sensor values in readings converted to the units,
+// see ConvertUnits.
+func (c UnitsConfig) Fields() []string {
+	selected := c.list()
+	fields := make([]string, 0, len(qingping.SensorFields))
+	for _, sensor := range qingping.SensorFields {
+		if len(selected[sensor]) == 0 {
+			fields = append(fields, sensor)
+			continue
+		}
+		for _, unit := range selected[sensor] {
+			name := sensor
+			if unit != nativeUnits[sensor] {
+				name += "_" + unit
+			}
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// ConvertUnits returns readings with values in selected units. Values in
+// the native unit keep the sensor name, values in other units are named
+// <sensor>_<unit>, e.g. temperature_fahrenheit. Values before calibration
+// are converted the same way, e.g. temperature_raw gives
+// temperature_fahrenheit_raw. Sensors without selected units are kept
+// as is. Original readings are not modified.
+func ConvertUnits(readings []Reading, units UnitsConfig) []Reading {
+	selected := units.list()
+	if len(units.Temperature)+len(units.TVOC)+len(units.Radon) == 0 {
+		return readings
+	}
+
+	converted := make([]Reading, len(readings))
+	for i, r := range readings {
+		fields := maps.Clone(r.Fields)
+		for field, list := range selected {
+			if len(list) == 0 {
+				continue
+			}
+			for _, suffix := range []string{"", RawSuffix} {
+				value, ok := r.Fields[field+suffix]
+				if !ok {
+					continue
+				}
+				delete(fields, field+suffix)
+				for _, unit := range list {
+					name := field
+					if unit != nativeUnits[field] {
+						name += "_" + unit
+					}
+					fields[name+suffix] = unitConversions[field][unit](value)
+				}
+			}
+		}
+		r.Fields = fields
+		converted[i] = r
+	}
+	return converted
+}
+
+// ValidField reports whether the name is a field of readings: a sensor
+// name, a value in a non-native unit (e.g. temperature_fahrenheit), or
+// any of them before calibration (e.g. co2_raw).
+func ValidField(name string) bool {
+	name = strings.TrimSuffix(name, RawSuffix)
+	if slices.Contains(qingping.SensorFields, name) {
+		return true
+	}
+	for sensor, units := range unitConversions {
+		for unit := range units {
+			if unit != nativeUnits[sensor] && name == sensor+"_"+unit {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConvertUnits(t *testing.T) {
+	fields := map[string]float64{"temperature": 25, "tvoc": 100, "radon": 74, "co2": 800}
+
+	testCases := []struct {
+		name     string
+		units    UnitsConfig
+		expected map[string]float64
+	}{
+		{
+			name:     "native units",
+			expected: fields,
+		},
+		{
+			name: "alongside native units",
+			units: UnitsConfig{
+				Temperature: []string{UnitCelsius, UnitFahrenheit},
+				TVOC:        []string{UnitPPB, UnitUGM3},
+			},
+			expected: map[string]float64{
+				"temperature": 25, "temperature_fahrenheit": 77,
+				"tvoc": 100, "tvoc_ugm3": 450,
+				"radon": 74, "co2": 800,
+			},
+		},
+		{
+			name: "instead of native units",
+			units: UnitsConfig{
+				Temperature: []string{UnitFahrenheit},
+				Radon:       []string{UnitPCIL},
+			},
+			expected: map[string]float64{
+				"temperature_fahrenheit": 77,
+				"tvoc":                   100,
+				"radon_pcil":             2,
+				"co2":                    800,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			readings := []Reading{{MAC: "MAC1", Fields: maps.Clone(fields)}}
+			converted := ConvertUnits(readings, tc.units)
+
+			equal := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+			if !maps.EqualFunc(converted[0].Fields, tc.expected, equal) {
+				t.Errorf("Expected %v, got %v", tc.expected, converted[0].Fields)
+			}
+			if !maps.Equal(readings[0].Fields, fields) {
+				t.Errorf("Original reading is modified: %v", readings[0].Fields)
+			}
+		})
+	}
+}
+
+func TestConvertUnitsRaw(t *testing.T) {
+	readings := []Reading{{MAC: "MAC1", Fields: map[string]float64{"temperature": 25, "temperature_raw": 30}}}
+	converted := ConvertUnits(readings, UnitsConfig{Temperature: []string{UnitCelsius, UnitFahrenheit}})
+
+	expected := map[string]float64{
+		"temperature": 25, "temperature_raw": 30,
+		"temperature_fahrenheit": 77, "temperature_fahrenheit_raw": 86,
+	}
+	if !maps.Equal(converted[0].Fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, converted[0].Fields)
+	}
+}
+
+func TestSinksDerivedFromNativeUnits(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Outputs.Sinks = []string{"prometheus"}
+	conf.Outputs.Units = map[string]UnitsConfig{
+		"prometheus": {Temperature: []string{UnitFahrenheit}},
+	}
+	metrics := NewMetrics(MetricsConfig{})
+	metrics.SetUnits(conf.Outputs.Units["prometheus"])
+	sinks, err := NewSinks(conf, SinkEnv{Metrics: metrics, Log: logrus.New()})
+	if err != nil {
+		t.Fatalf("Failed to create sinks: %v", err)
+	}
+	sinks.Start()
+	sinks.Write(Reading{
+		MAC:    "MAC1",
+		Time:   time.Now(),
+		Fields: map[string]float64{"temperature": 25, "humidity": 50},
+	})
+	if err := sinks.Stop(); err != nil {
+		t.Fatalf("Failed to stop sinks: %v", err)
+	}
+
+	for _, name := range []string{"qingping_temperature_fahrenheit", "qingping_dew_point_celsius"} {
+		if !gathered(t, metrics, name) {
+			t.Errorf("Metric %s is not exported", name)
+		}
+	}
+	if gathered(t, metrics, "qingping_temperature_celsius") {
+		t.Error("Unexpected metric in native unit")
+	}
+}
+
+func TestUnitsFields(t *testing.T) {
+	fields := UnitsConfig{
+		Temperature: []string{UnitFahrenheit},
+		Radon:       []string{UnitBQM3, UnitPCIL},
+	}.Fields()
+	expected := []string{
+		"temperature_fahrenheit", "humidity", "co2", "pm1", "pm25",
+		"pm10", "tvoc", "radon", "radon_pcil", "battery",
+	}
+	if !slices.Equal(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+}
+
+func TestValidField(t *testing.T) {
+	valid := []string{"co2", "co2_raw", "temperature_fahrenheit", "temperature_fahrenheit_raw", "radon_pcil"}
+	for _, name := range valid {
+		if !ValidField(name) {
+			t.Errorf("Expected %s to be valid", name)
+		}
+	}
+	invalid := []string{"", "unknown", "temperature_celsius", "co2_fahrenheit", "raw"}
+	for _, name := range invalid {
+		if ValidField(name) {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// WebHandler returns handler for the static web dashboard.
+func WebHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		// Can only happen if the embed directive is broken
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
@@ -0,0 +1,148 @@
+"use strict";
+
+// How often device states and history are refreshed without events.
+const refreshInterval = 60 * 1000;
+// Delay of refresh after an event, to handle bursts of history at once.
+const eventDelay = 500;
+const historyRange = 6 * 60 * 60; // seconds
+const historyStep = "5m";
+
+// Sensors in display order with units.
+const sensors = [
+  ["temperature", "Temperature", "°C"],
+  ["humidity", "Humidity", "%"],
+  ["co2", "CO2", "ppm"],
+  ["pm1", "PM1", "µg/m³"],
+  ["pm25", "PM2.5", "µg/m³"],
+  ["pm10", "PM10", "µg/m³"],
+  ["tvoc", "TVOC", "ppb"],
+  ["radon", "Radon", "Bq/m³"],
+  ["battery", "Battery", "%"],
+];
+
+// Sensors shown on the sparkline, the first available one is used.
+const sparklineSensors = ["co2", "pm25", "temperature"];
+
+async function getJSON(url) {
+  const resp = await fetch(url);
+  if (!resp.ok) {
+    throw new Error(`${url}: ${resp.status}`);
+  }
+  return resp.json();
+}
+
+function el(tag, attrs = {}, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs)) {
+    node.setAttribute(k, v);
+  }
+  node.append(...children);
+  return node;
+}
+
+function format(value) {
+  return Number.isInteger(value) ? String(value) : value.toFixed(1);
+}
+
+function sparkline(points) {
+  const ns = "http://www.w3.org/2000/svg";
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("class", "sparkline");
+  svg.setAttribute("viewBox", "0 0 100 30");
+  svg.setAttribute("preserveAspectRatio", "none");
+  if (points.length < 2) {
+    return svg;
+  }
+
+  const times = points.map((p) => Date.parse(p.time));
+  const values = points.map((p) => p.value);
+  const [t0, t1] = [Math.min(...times), Math.max(...times)];
+  const [v0, v1] = [Math.min(...values), Math.max(...values)];
+  const coords = points.map((p, i) => {
+    const x = ((times[i] - t0) / (t1 - t0)) * 100;
+    const y = v1 === v0 ? 15 : 29 - ((p.value - v0) / (v1 - v0)) * 28;
+    return `${x.toFixed(2)},${y.toFixed(2)}`;
+  });
+
+  const line = document.createElementNS(ns, "polyline");
+  line.setAttribute("points", coords.join(" "));
+  svg.append(line);
+  return svg;
+}
+
+async function history(mac, field) {
+  const from = Math.floor(Date.now() / 1000) - historyRange;
+  const url = `api/devices/${encodeURIComponent(mac)}/readings` +
+    `?field=${field}&from=${from}&step=${historyStep}`;
+  try {
+    return (await getJSON(url)).points;
+  } catch {
+    return [];
+  }
+}
+
+async function card(device) {
+  const status = el("span", {
+    class: device.online ? "status online" : "status",
+    title: device.online ? "online" : "offline",
+  });
+  const title = el("h2", {}, status, device.name || device.mac);
+
+  const meta = [device.mac, device.model].filter(Boolean).join(" · ");
+  const seen = device.last_seen
+    ? `last seen ${new Date(device.last_seen).toLocaleString()}`
+    : "never seen";
+
+  const readings = el("dl", { class: "readings" });
+  for (const [field, name, unit] of sensors) {
+    const r = device.readings[field];
+    if (r) {
+      readings.append(el("dt", {}, name), el("dd", {}, `${format(r.value)} ${unit}`));
+    }
+  }
+
+  const field = sparklineSensors.find((f) => f in device.readings);
+  const children = [title, el("div", { class: "meta" }, meta), readings];
+  if (field) {
+    const label = sensors.find(([f]) => f === field)[1];
+    children.push(
+      el("div", { class: "meta" }, `${label}, last 6 hours`),
+      sparkline(await history(device.mac, field)),
+    );
+  }
+  children.push(el("div", { class: "meta" }, seen));
+  return el("section", { class: "card" }, ...children);
+}
+
+async function refresh() {
+  try {
+    const { devices } = await getJSON("api/devices");
+    const cards = await Promise.all(devices.map(card));
+    document.getElementById("devices").replaceChildren(...cards);
+    document.getElementById("empty").hidden = devices.length > 0;
+    document.getElementById("updated").textContent =
+      `updated ${new Date().toLocaleTimeString()}`;
+  } catch (err) {
+    document.getElementById("updated").textContent = `update failed: ${err.message}`;
+  }
+}
+
+let pending = null;
+
+function scheduleRefresh() {
+  if (pending === null) {
+    pending = setTimeout(() => {
+      pending = null;
+      refresh();
+    }, eventDelay);
+  }
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
+
+// Refresh on new readings and online status changes
+const stream = new EventSource("api/events?type=reading,online,offline");
+for (const type of ["reading", "online", "offline"]) {
+  stream.addEventListener(type, scheduleRefresh);
+}